@@ -1,15 +1,27 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"time"
+
+	"github.com/turchenkoalex/ecwid-images-downloader/limiter"
 )
 
 var apiBaseURL = "https://app.ecwid.com/api/v3"
 
+// apiLimiter - limits requests to API, nil means no limit
+var apiLimiter *limiter.Limiter
+
+// SetRateLimiter - limit rate of all API requests
+func SetRateLimiter(limiter *limiter.Limiter) {
+	apiLimiter = limiter
+}
+
 // Products - https://api-docs.ecwid.com/reference/products#response
 type Products struct {
 	Total  int
@@ -21,15 +33,23 @@ type Products struct {
 
 // Product - https://api-docs.ecwid.com/reference/products#productentry
 type Product struct {
-	ID    int
-	Name  string
-	Media ProductMedia
+	ID                int
+	Sku               string
+	Name              string
+	NameTranslated    map[string]string
+	Media             ProductMedia
+	CategoryIds       []int
+	DefaultCategoryID int
+	Updated           string
+	UpdateTimestamp   int64
 }
 
 // ProductCombination - https://api-docs.ecwid.com/reference/variations#response
 type ProductCombination struct {
 	ID                int
 	CombinationNumber int
+	Sku               string
+	Options           []CombinationOption
 	ThumbnailUrl      string
 	ImageUrl          string
 	SmallThumbnailUrl string
@@ -37,6 +57,14 @@ type ProductCombination struct {
 	OriginalImageUrl  string
 }
 
+// CombinationOption - https://api-docs.ecwid.com/reference/variations#options
+type CombinationOption struct {
+	Name            string
+	NameTranslated  map[string]string
+	Value           string
+	ValueTranslated map[string]string
+}
+
 // ProductMedia - https://api-docs.ecwid.com/reference/products#productmedia
 type ProductMedia struct {
 	Images []ProductImage
@@ -45,6 +73,7 @@ type ProductMedia struct {
 // ProductImage - https://api-docs.ecwid.com/reference/products#productimage
 type ProductImage struct {
 	ID               string
+	Alt              ProductImageAlt
 	ImageOriginalURL string
 	Image1500pxURL   string
 	Image800pxURL    string
@@ -52,6 +81,12 @@ type ProductImage struct {
 	Image160pxURL    string
 }
 
+// ProductImageAlt - https://api-docs.ecwid.com/reference/products#productimage
+type ProductImageAlt struct {
+	Main       string
+	Translated map[string]string
+}
+
 // Categories - https://api-docs.ecwid.com/reference/categories#response
 type Categories struct {
 	Total  int
@@ -64,15 +99,76 @@ type Categories struct {
 // Category - https://api-docs.ecwid.com/reference/categories#category
 type Category struct {
 	ID               int
+	ParentID         int
 	Name             string
+	NameTranslated   map[string]string
 	OriginalImageUrl string
+	Updated          string
+	UpdateTimestamp  int64
+}
+
+// LocalName - product name translated to the language, default name when there is no translation
+func (product Product) LocalName(lang string) string {
+	return translatedName(product.Name, product.NameTranslated, lang)
+}
+
+// LocalName - category name translated to the language, default name when there is no translation
+func (category Category) LocalName(lang string) string {
+	return translatedName(category.Name, category.NameTranslated, lang)
+}
+
+// LocalName - option name translated to the language, default name when there is no translation
+func (option CombinationOption) LocalName(lang string) string {
+	return translatedName(option.Name, option.NameTranslated, lang)
+}
+
+// LocalValue - option value translated to the language, default value when there is no translation
+func (option CombinationOption) LocalValue(lang string) string {
+	return translatedName(option.Value, option.ValueTranslated, lang)
+}
+
+// updatedLayouts - formats of updated field seen in API responses
+var updatedLayouts = []string{
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02T15:04:05-0700",
+	time.RFC3339,
+}
+
+// UpdatedUnix - time of the last product update in unix seconds, 0 if unknown
+func (product Product) UpdatedUnix() int64 {
+	return updatedUnix(product.Updated, product.UpdateTimestamp)
+}
+
+// UpdatedUnix - time of the last category update in unix seconds, 0 if unknown
+func (category Category) UpdatedUnix() int64 {
+	return updatedUnix(category.Updated, category.UpdateTimestamp)
+}
+
+func updatedUnix(updated string, timestamp int64) int64 {
+	if timestamp > 0 {
+		return timestamp
+	}
+
+	for _, layout := range updatedLayouts {
+		if parsed, err := time.Parse(layout, updated); err == nil {
+			return parsed.Unix()
+		}
+	}
+	return 0
+}
+
+func translatedName(name string, translations map[string]string, lang string) string {
+	if translated := translations[lang]; lang != "" && translated != "" {
+		return translated
+	}
+	return name
 }
 
 // LoadProducts - load products from api v3
-func LoadProducts(httpClient *http.Client, storeID int64, apiToken string, offset int, limit int) (Products, error) {
+func LoadProducts(ctx context.Context, httpClient *http.Client, storeID int64, apiToken string, offset int, limit int) (Products, error) {
 	products := &Products{}
 	url := buildProductsURL(storeID, apiToken, offset, limit)
-	err := readJSON(httpClient, url, products)
+	err := readJSON(ctx, httpClient, url, products)
 	if err != nil {
 		return *products, err
 	}
@@ -81,10 +177,10 @@ func LoadProducts(httpClient *http.Client, storeID int64, apiToken string, offse
 }
 
 // LoadCategories - load categories from api v3
-func LoadCategories(httpClient *http.Client, storeID int64, apiToken string, offset int, limit int) (Categories, error) {
+func LoadCategories(ctx context.Context, httpClient *http.Client, storeID int64, apiToken string, offset int, limit int) (Categories, error) {
 	categories := &Categories{}
 	url := buildCategoriesURL(storeID, apiToken, offset, limit)
-	err := readJSON(httpClient, url, categories)
+	err := readJSON(ctx, httpClient, url, categories)
 	if err != nil {
 		return *categories, err
 	}
@@ -92,11 +188,27 @@ func LoadCategories(httpClient *http.Client, storeID int64, apiToken string, off
 	return *categories, nil
 }
 
+// LoadAllCategories - load all categories page by page
+func LoadAllCategories(ctx context.Context, httpClient *http.Client, storeID int64, apiToken string, limit int) ([]Category, error) {
+	var all []Category
+	for offset := 0; ; offset += limit {
+		categories, err := LoadCategories(ctx, httpClient, storeID, apiToken, offset, limit)
+		if err != nil {
+			return nil, err
+		}
+
+		all = append(all, categories.Items...)
+		if len(categories.Items) == 0 || offset+limit >= categories.Total {
+			return all, nil
+		}
+	}
+}
+
 // LoadProductCombinations - load product combinations from api v3
-func LoadProductCombinations(httpClient *http.Client, storeID int64, apiToken string, productId int) ([]ProductCombination, error) {
+func LoadProductCombinations(ctx context.Context, httpClient *http.Client, storeID int64, apiToken string, productId int) ([]ProductCombination, error) {
 	var productCombinations []ProductCombination
 	url := buildProductCombinationsURL(storeID, apiToken, productId)
-	err := readJSON(httpClient, url, &productCombinations)
+	err := readJSON(ctx, httpClient, url, &productCombinations)
 	if err != nil {
 		return productCombinations, err
 	}
@@ -105,8 +217,8 @@ func LoadProductCombinations(httpClient *http.Client, storeID int64, apiToken st
 }
 
 // LoadProductsTotalCount - load products total count
-func LoadProductsTotalCount(httpClient *http.Client, storeID int64, apiToken string) (int, error) {
-	products, err := LoadProducts(httpClient, storeID, apiToken, 0, 0)
+func LoadProductsTotalCount(ctx context.Context, httpClient *http.Client, storeID int64, apiToken string) (int, error) {
+	products, err := LoadProducts(ctx, httpClient, storeID, apiToken, 0, 0)
 	if err != nil {
 		return 0, err
 	}
@@ -115,8 +227,8 @@ func LoadProductsTotalCount(httpClient *http.Client, storeID int64, apiToken str
 }
 
 // LoadCategoriesTotalCount - load categories total count
-func LoadCategoriesTotalCount(httpClient *http.Client, storeID int64, apiToken string) (int, error) {
-	categories, err := LoadCategories(httpClient, storeID, apiToken, 0, 0)
+func LoadCategoriesTotalCount(ctx context.Context, httpClient *http.Client, storeID int64, apiToken string) (int, error) {
+	categories, err := LoadCategories(ctx, httpClient, storeID, apiToken, 0, 0)
 	if err != nil {
 		return 0, err
 	}
@@ -136,8 +248,17 @@ func buildCategoriesURL(storeID int64, apiToken string, offset int, limit int) s
 	return fmt.Sprintf("%s/%d/categories?token=%s&limit=%d&offset=%d", apiBaseURL, storeID, apiToken, limit, offset)
 }
 
-func readJSON(httpClient *http.Client, url string, target interface{}) error {
-	response, err := httpClient.Get(url)
+func readJSON(ctx context.Context, httpClient *http.Client, url string, target interface{}) error {
+	if err := apiLimiter.Wait(ctx); err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := httpClient.Do(request)
 	if err != nil {
 		return err
 	}
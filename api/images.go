@@ -2,56 +2,144 @@ package api
 
 import (
 	"fmt"
+	"path"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
+// Image sources
+const (
+	SourceProduct     = "product"
+	SourceCombination = "combination"
+	SourceCategory    = "category"
+)
+
 // Image data
 type Image struct {
-	FileName string
-	Dir      string
-	URL      string
+	FileName   string `json:"fileName"`
+	Dir        string `json:"dir"`
+	URL        string `json:"url"`
+	Source     string `json:"source,omitempty"`
+	ProductID  int    `json:"productId,omitempty"`
+	CategoryID int    `json:"categoryId,omitempty"`
+	ImageID    string `json:"imageId,omitempty"`
+	Updated    int64  `json:"updated,omitempty"`
+
+	// Metadata - catalog entities the image was made from, not saved to plans and reports and dropped when
+	// the image is scheduled, so queues don't keep whole products in memory
+	Metadata *ImageMetadata `json:"-"`
+}
+
+// ImageMetadata - catalog entities the image was made from
+type ImageMetadata struct {
+	Product      *Product
+	ProductImage *ProductImage
+	Position     int
+	Combination  *ProductCombination
+	Category     *Category
+}
+
+// Path - relative path of the image file in the download dir
+func (image Image) Path() string {
+	return path.Join(image.Dir, image.FileName)
 }
 
 // Images - extract all available images from products structure
-func (product Product) Images(includeNames bool) []Image {
+func (product Product) Images(naming *Naming) []Image {
 	var images []Image
-	for _, image := range product.Media.Images {
-		var downloadableImage Image
+	for _, variant := range naming.variants() {
+		categoryPaths := naming.categoryPathsOf(product, variant.lang)
+		name := naming.name(product.LocalName(variant.lang))
+
+		for position, image := range product.Media.Images {
+			var downloadableImage Image
+
+			downloadableImage.Source = SourceProduct
+			downloadableImage.ProductID = product.ID
+			downloadableImage.ImageID = image.ID
+			downloadableImage.Updated = product.UpdatedUnix()
+			downloadableImage.Metadata = &ImageMetadata{Product: &product, ProductImage: &image, Position: position + 1}
+
+			if image.ImageOriginalURL != "" {
+				downloadableImage.URL = image.ImageOriginalURL
+			} else if image.Image1500pxURL != "" {
+				downloadableImage.URL = image.Image1500pxURL
+			} else if image.Image800pxURL != "" {
+				downloadableImage.URL = image.Image800pxURL
+			} else if image.Image400pxURL != "" {
+				downloadableImage.URL = image.Image400pxURL
+			} else {
+				downloadableImage.URL = image.Image160pxURL
+			}
+
+			if downloadableImage.URL == "" {
+				if variant.root == "" {
+					fmt.Printf("Not found image for product %d\n", product.ID)
+				}
+				continue
+			}
+
+			images = append(images, naming.place(downloadableImage, naming.Product, variant.root, categoryPaths, map[string]string{
+				PlaceholderProductID: strconv.Itoa(product.ID),
+				PlaceholderImageID:   image.ID,
+				PlaceholderPosition:  strconv.Itoa(position + 1),
+				PlaceholderName:      name,
+				PlaceholderSku:       naming.productSku(product),
+			})...)
+		}
+	}
+	return images
+}
 
-		if includeNames {
-			// Use product name in image file name
-			downloadableImage.FileName = fmt.Sprintf("p%d-%s-%s.jpg", product.ID, image.ID, sanitizeFilename(product.Name))
-		} else {
-			// Use product ID and image ID in file name
-			downloadableImage.FileName = fmt.Sprintf("p%d-%s.jpg", product.ID, image.ID)
+// CombinationImages - images of product combinations. Combination SKU used in paths falls back to
+// p{product_id}-c{combination_number} when it is empty, equals SKU of the product or of a previous combination
+// or equals a name of product image like {sku}-1.
+func (product Product) CombinationImages(combinations []ProductCombination, naming *Naming) []Image {
+	productSku := naming.productSku(product)
+	combinationSkus := make([]string, len(combinations))
+	if naming.UsesSkus() {
+		usedSkus := map[string]bool{strings.ToLower(productSku): true}
+		for position := range product.Media.Images {
+			usedSkus[strings.ToLower(fmt.Sprintf("%s-%d", productSku, position+1))] = true
 		}
 
-		downloadableImage.Dir = "products"
-
-		if image.ImageOriginalURL != "" {
-			downloadableImage.URL = image.ImageOriginalURL
-		} else if image.Image1500pxURL != "" {
-			downloadableImage.URL = image.Image1500pxURL
-		} else if image.Image800pxURL != "" {
-			downloadableImage.URL = image.Image800pxURL
-		} else if image.Image400pxURL != "" {
-			downloadableImage.URL = image.Image400pxURL
-		} else {
-			downloadableImage.URL = image.Image160pxURL
+		for i, combination := range combinations {
+			combinationSku := skuValue(combination.Sku)
+			if combinationSku == "" || usedSkus[strings.ToLower(combinationSku)] {
+				combinationSku = fmt.Sprintf("p%d-c%d", product.ID, combination.CombinationNumber)
+			}
+			usedSkus[strings.ToLower(combinationSku)] = true
+			combinationSkus[i] = combinationSku
 		}
+	}
 
-		if downloadableImage.URL != "" {
-			images = append(images, downloadableImage)
-		} else {
-			fmt.Printf("Not found image for product %d\n", product.ID)
+	var images []Image
+	for _, variant := range naming.variants() {
+		categoryPaths := naming.categoryPathsOf(product, variant.lang)
+		name := naming.name(product.LocalName(variant.lang))
+
+		for i, combination := range combinations {
+			image := combination.image(product)
+			if image == nil {
+				continue
+			}
+
+			images = append(images, naming.place(*image, naming.Combination, variant.root, categoryPaths, map[string]string{
+				PlaceholderProductID:         strconv.Itoa(product.ID),
+				PlaceholderCombinationNumber: strconv.Itoa(combination.CombinationNumber),
+				PlaceholderCombinationID:     strconv.Itoa(combination.ID),
+				PlaceholderName:              name,
+				PlaceholderSku:               productSku,
+				PlaceholderCombinationSku:    combinationSkus[i],
+				PlaceholderOptions:           naming.options(combination, variant.lang),
+			})...)
 		}
 	}
 	return images
 }
 
-// Image - get image
-func (combination ProductCombination) Image(productId int, productName string, includeNames bool) *Image {
+func (combination ProductCombination) image(product Product) *Image {
 	var image Image
 
 	if combination.OriginalImageUrl != "" {
@@ -70,38 +158,38 @@ func (combination ProductCombination) Image(productId int, productName string, i
 		return nil
 	}
 
-	if includeNames {
-		// Use product name in image file name
-		image.FileName = fmt.Sprintf("p%d-c%d-%s.jpg", productId, combination.CombinationNumber, sanitizeFilename(productName))
-	} else {
-		// Use product ID and combination number in file name
-		image.FileName = fmt.Sprintf("p%d-c%d.jpg", productId, combination.CombinationNumber)
-	}
-
-	image.Dir = "products"
+	image.Source = SourceCombination
+	image.ProductID = product.ID
+	image.ImageID = fmt.Sprintf("c%d", combination.CombinationNumber)
+	image.Updated = product.UpdatedUnix()
+	image.Metadata = &ImageMetadata{Product: &product, Combination: &combination}
 
 	return &image
 }
 
-// Image - get category image
-func (category Category) Image(includeName bool) *Image {
+// Images - get category image, one for every language tree
+func (category Category) Images(naming *Naming) []Image {
 	if category.OriginalImageUrl == "" {
 		return nil
 	}
 
-	var downloadableImage Image
+	var images []Image
+	for _, variant := range naming.variants() {
+		var downloadableImage Image
 
-	if includeName {
-		// Use category name in image file name
-		downloadableImage.FileName = fmt.Sprintf("cat%d-%s.jpg", category.ID, sanitizeFilename(category.Name))
-	} else {
-		// Use category ID in file name
-		downloadableImage.FileName = fmt.Sprintf("cat%d.jpg", category.ID)
+		downloadableImage.URL = category.OriginalImageUrl
+		downloadableImage.Source = SourceCategory
+		downloadableImage.CategoryID = category.ID
+		downloadableImage.Updated = category.UpdatedUnix()
+		downloadableImage.Metadata = &ImageMetadata{Category: &category}
+
+		naming.apply(&downloadableImage, naming.Category, variant.root, map[string]string{
+			PlaceholderCategoryID: strconv.Itoa(category.ID),
+			PlaceholderName:       naming.name(category.LocalName(variant.lang)),
+		})
+		images = append(images, downloadableImage)
 	}
-
-	downloadableImage.URL = category.OriginalImageUrl
-	downloadableImage.Dir = "categories"
-	return &downloadableImage
+	return images
 }
 
 const maxFilenameLength = 255
@@ -113,9 +201,7 @@ func sanitizeFilename(name string) string {
 	name = strings.ReplaceAll(name, " ", "_")
 	name = invalidChars.ReplaceAllString(name, "")
 
-	if len(name) > maxFilenameLength {
-		name = name[:maxFilenameLength]
-	}
+	name = TruncateFilename(name, "")
 
 	if name == "" {
 		name = "unnamed"
@@ -123,3 +209,21 @@ func sanitizeFilename(name string) string {
 
 	return name
 }
+
+// TruncateFilename - name with suffix (extension or collision suffix) which fits into maxFilenameLength bytes,
+// the name is cut at rune boundary, so multibyte letters are never broken
+func TruncateFilename(name string, suffix string) string {
+	limit := maxFilenameLength - len(suffix)
+	if len(name) <= limit {
+		return name + suffix
+	}
+
+	cut := 0
+	for index := range name {
+		if index > limit {
+			break
+		}
+		cut = index
+	}
+	return name[:cut] + suffix
+}
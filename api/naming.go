@@ -0,0 +1,589 @@
+package api
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Path template placeholders
+const (
+	PlaceholderProductID         = "product_id"
+	PlaceholderImageID           = "image_id"
+	PlaceholderPosition          = "position"
+	PlaceholderName              = "name"
+	PlaceholderExt               = "ext"
+	PlaceholderCombinationNumber = "combination_number"
+	PlaceholderCombinationID     = "combination_id"
+	PlaceholderCategoryID        = "category_id"
+	PlaceholderSku               = "sku"
+	PlaceholderCombinationSku    = "combination_sku"
+	PlaceholderCategoryPath      = "category_path"
+	PlaceholderOptions           = "options"
+)
+
+// Layouts of product images, they select default path templates
+const (
+	LayoutFlat       = "flat"
+	LayoutCategories = "categories"
+)
+
+// Placement of products which belong to several categories
+const (
+	MultiCategoryDefault       = "default"
+	MultiCategoryLinks         = "links"
+	MultiCategoryUncategorized = "uncategorized"
+)
+
+// LangTreesDir - root of per-language trees, lang/{code}/ repeats the main layout with translated names
+const LangTreesDir = "lang"
+
+// UncategorizedDir - category path of products without categories
+const UncategorizedDir = "uncategorized"
+
+// Naming modes, they select default path templates
+const (
+	NamingID      = "id"
+	NamingSku     = "sku"
+	NamingOptions = "options"
+)
+
+// Default path templates of id naming mode, they reproduce the fixed layout of previous versions
+const (
+	DefaultProductTemplate     = "products/p{product_id}-{image_id}.jpg"
+	DefaultCombinationTemplate = "products/p{product_id}-c{combination_number}.jpg"
+	DefaultCategoryTemplate    = "categories/cat{category_id}.jpg"
+)
+
+// Default path templates of sku naming mode, combinations are in a dir of their product,
+// so a combination SKU like TEE-1 never takes the path of the first image of product TEE
+const (
+	SkuProductTemplate     = "products/{sku}-{position}.jpg"
+	SkuCombinationTemplate = "products/{sku}/{combination_sku}.jpg"
+)
+
+// OptionsCombinationTemplate - default combination template of options naming mode
+const OptionsCombinationTemplate = "products/p{product_id}-{options}.jpg"
+
+var (
+	productPlaceholders = []string{
+		PlaceholderProductID, PlaceholderImageID, PlaceholderPosition, PlaceholderName, PlaceholderExt, PlaceholderSku,
+		PlaceholderCategoryPath,
+	}
+	combinationPlaceholders = []string{
+		PlaceholderProductID, PlaceholderCombinationNumber, PlaceholderCombinationID, PlaceholderName, PlaceholderExt,
+		PlaceholderSku, PlaceholderCombinationSku, PlaceholderCategoryPath, PlaceholderOptions,
+	}
+	categoryPlaceholders = []string{
+		PlaceholderCategoryID, PlaceholderName, PlaceholderExt,
+	}
+)
+
+// pathPlaceholders - values of these placeholders are made of several sanitized path segments
+var pathPlaceholders = map[string]bool{
+	PlaceholderCategoryPath: true,
+}
+
+var placeholderPattern = regexp.MustCompile(`\{([a-z_]+)(?::(\d+))?\}`)
+
+// Template - parsed path template like products/{product_id}/{position:02}-{image_id}.{ext}
+type Template struct {
+	text    string
+	parts   []templatePart
+	pattern *regexp.Regexp
+}
+
+// templatePart - literal text or placeholder with optional zero padding width
+type templatePart struct {
+	literal     string
+	placeholder string
+	width       int
+}
+
+// ParseTemplate - parse and validate template, only given placeholders are allowed
+func ParseTemplate(text string, placeholders []string) (*Template, error) {
+	allowed := make(map[string]bool, len(placeholders))
+	for _, placeholder := range placeholders {
+		allowed[placeholder] = true
+	}
+
+	template := &Template{text: text}
+	position := 0
+	for _, match := range placeholderPattern.FindAllStringSubmatchIndex(text, -1) {
+		if match[0] > position {
+			template.parts = append(template.parts, templatePart{literal: text[position:match[0]]})
+		}
+
+		name := text[match[2]:match[3]]
+		if !allowed[name] {
+			return nil, fmt.Errorf("unknown placeholder {%s} in %q, available: {%s}", name, text, strings.Join(placeholders, "}, {"))
+		}
+
+		part := templatePart{placeholder: name}
+		if match[4] >= 0 {
+			part.width, _ = strconv.Atoi(text[match[4]:match[5]])
+		}
+		template.parts = append(template.parts, part)
+		position = match[1]
+	}
+	if position < len(text) {
+		template.parts = append(template.parts, templatePart{literal: text[position:]})
+	}
+
+	if err := template.validate(); err != nil {
+		return nil, fmt.Errorf("invalid template %q: %w", text, err)
+	}
+	template.pattern = template.compile()
+
+	return template, nil
+}
+
+// compile - pattern of paths the template may render, placeholders match any value and collision
+// suffixes like -2 are allowed before the extension
+func (template *Template) compile() *regexp.Regexp {
+	lastLiteral := -1
+	for i, part := range template.parts {
+		if part.placeholder == "" {
+			lastLiteral = i
+		}
+	}
+
+	var pattern strings.Builder
+	pattern.WriteString("(?i)^")
+	for i, part := range template.parts {
+		switch {
+		case pathPlaceholders[part.placeholder]:
+			pattern.WriteString(".*")
+		case part.placeholder != "":
+			pattern.WriteString("[^/]*")
+		default:
+			literal := part.literal
+			dot := strings.LastIndex(literal, ".")
+			if i == lastLiteral && dot > strings.LastIndex(literal, "/") {
+				pattern.WriteString(regexp.QuoteMeta(literal[:dot]) + "(?:-[^/]*)?" + regexp.QuoteMeta(literal[dot:]))
+				continue
+			}
+			pattern.WriteString(regexp.QuoteMeta(literal))
+		}
+	}
+	pattern.WriteString("$")
+
+	return regexp.MustCompile(pattern.String())
+}
+
+// Matches - file path could be rendered by the template
+func (template *Template) Matches(filePath string) bool {
+	return template.pattern.MatchString(filePath)
+}
+
+func (template *Template) validate() error {
+	hasPlaceholder := false
+	var literals strings.Builder
+	for _, part := range template.parts {
+		if part.placeholder != "" {
+			hasPlaceholder = true
+			// placeholder values never contain separators
+			literals.WriteString("x")
+			continue
+		}
+
+		if strings.ContainsAny(part.literal, "{}") {
+			return fmt.Errorf("unmatched brace")
+		}
+		if strings.Contains(part.literal, "\\") {
+			return fmt.Errorf("use / as path separator")
+		}
+		literals.WriteString(part.literal)
+	}
+
+	if !hasPlaceholder {
+		return fmt.Errorf("no placeholders, all images would be saved to the same file")
+	}
+
+	text := literals.String()
+	if strings.HasPrefix(text, "/") || strings.HasSuffix(text, "/") {
+		return fmt.Errorf("path must be relative to the download dir and end with a file name")
+	}
+
+	for _, segment := range strings.Split(text, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("empty, . and .. path segments are not allowed")
+		}
+	}
+
+	return nil
+}
+
+// Root - top level dir of all paths made by the template, empty if it depends on placeholders
+func (template *Template) Root() string {
+	if len(template.parts) == 0 || template.parts[0].placeholder != "" {
+		return ""
+	}
+
+	root, _, found := strings.Cut(template.parts[0].literal, "/")
+	if !found {
+		return ""
+	}
+	return root
+}
+
+// Uses - template contains the placeholder
+func (template *Template) Uses(placeholder string) bool {
+	for _, part := range template.parts {
+		if part.placeholder == placeholder {
+			return true
+		}
+	}
+	return false
+}
+
+func (template *Template) String() string {
+	return template.text
+}
+
+// Render - substitute placeholder values, they are sanitized so a value can't add path segments
+func (template *Template) Render(values map[string]string) string {
+	var result strings.Builder
+	for _, part := range template.parts {
+		if part.placeholder == "" {
+			result.WriteString(part.literal)
+			continue
+		}
+
+		value := values[part.placeholder]
+		if !pathPlaceholders[part.placeholder] {
+			value = invalidChars.ReplaceAllString(value, "")
+		}
+		if len(value) < part.width {
+			value = strings.Repeat("0", part.width-len(value)) + value
+		}
+		result.WriteString(value)
+	}
+	return result.String()
+}
+
+// Naming - path templates of product, combination and category images
+type Naming struct {
+	Product     *Template
+	Combination *Template
+	Category    *Template
+
+	multiCategory string
+	transliterate bool
+	policy        string
+	lang          string
+	treeLangs     []string
+
+	// product SKU in lower case -> ID of the product which uses it in paths
+	mutex       sync.Mutex
+	productSkus map[string]int
+
+	// language -> category ID -> path of sanitized category names from the root category
+	categoryPaths map[string]map[int]string
+}
+
+// variant - names language and root dir of one tree of images
+type variant struct {
+	lang string
+	root string
+}
+
+// CreateNaming - parse path templates, empty template means the default one of the naming mode
+func CreateNaming(mode string, layout string, multiCategory string, productTemplate string, combinationTemplate string, categoryTemplate string, includeNames bool, transliterate bool, policy string, lang string, treeLangs []string) (*Naming, error) {
+	var defaultProduct, defaultCombination string
+	switch mode {
+	case NamingID:
+		defaultProduct, defaultCombination = DefaultProductTemplate, DefaultCombinationTemplate
+	case NamingSku:
+		defaultProduct, defaultCombination = SkuProductTemplate, SkuCombinationTemplate
+	case NamingOptions:
+		defaultProduct, defaultCombination = DefaultProductTemplate, OptionsCombinationTemplate
+	default:
+		return nil, fmt.Errorf("unknown naming mode %s, expected id, sku or options", mode)
+	}
+
+	switch layout {
+	case LayoutFlat:
+	case LayoutCategories:
+		defaultProduct = categoriesLayout(defaultProduct)
+		defaultCombination = categoriesLayout(defaultCombination)
+	default:
+		return nil, fmt.Errorf("unknown layout %s, expected flat or categories", layout)
+	}
+
+	if multiCategory != MultiCategoryDefault && multiCategory != MultiCategoryLinks && multiCategory != MultiCategoryUncategorized {
+		return nil, fmt.Errorf("unknown multi-category mode %s, expected default, links or uncategorized", multiCategory)
+	}
+
+	if !ValidPolicy(policy) {
+		return nil, fmt.Errorf("unknown file name policy %s, expected posix, windows or ascii", policy)
+	}
+
+	if productTemplate == "" {
+		productTemplate = defaultTemplate(defaultProduct, includeNames)
+	}
+
+	if combinationTemplate == "" {
+		combinationTemplate = defaultTemplate(defaultCombination, includeNames)
+	}
+
+	if categoryTemplate == "" {
+		categoryTemplate = defaultTemplate(DefaultCategoryTemplate, includeNames)
+	}
+
+	naming := Naming{multiCategory: multiCategory, transliterate: transliterate, policy: policy, lang: lang, productSkus: make(map[string]int)}
+	for _, treeLang := range treeLangs {
+		if treeLang != lang && !slices.Contains(naming.treeLangs, treeLang) {
+			naming.treeLangs = append(naming.treeLangs, treeLang)
+		}
+	}
+	var err error
+	if naming.Product, err = ParseTemplate(productTemplate, productPlaceholders); err != nil {
+		return nil, err
+	}
+	if naming.Combination, err = ParseTemplate(combinationTemplate, combinationPlaceholders); err != nil {
+		return nil, err
+	}
+	if naming.Category, err = ParseTemplate(categoryTemplate, categoryPlaceholders); err != nil {
+		return nil, err
+	}
+
+	return &naming, nil
+}
+
+// defaultTemplate - default template with name before the extension when names are included
+func defaultTemplate(template string, includeNames bool) string {
+	if !includeNames {
+		return template
+	}
+	return strings.TrimSuffix(template, ".jpg") + "-{name}.jpg"
+}
+
+// categoriesLayout - default template with product images inside folders of their categories
+func categoriesLayout(template string) string {
+	return strings.Replace(template, "products/", "products/{category_path}/", 1)
+}
+
+// UsesSkus - templates name images by SKU, product SKUs are registered only then
+func (naming *Naming) UsesSkus() bool {
+	return naming.Product.Uses(PlaceholderSku) || naming.Combination.Uses(PlaceholderSku) ||
+		naming.Combination.Uses(PlaceholderCombinationSku)
+}
+
+// EntityUnique - every template contains an ID of the product, combination or category, so images of different
+// entities never share a path, even when they are processed by different processes
+func (naming *Naming) EntityUnique() error {
+	templates := []struct {
+		template     *Template
+		placeholders []string
+	}{
+		{naming.Product, []string{PlaceholderProductID, PlaceholderImageID}},
+		{naming.Combination, []string{PlaceholderProductID, PlaceholderCombinationID}},
+		{naming.Category, []string{PlaceholderCategoryID}},
+	}
+
+	for _, entity := range templates {
+		if !slices.ContainsFunc(entity.placeholders, entity.template.Uses) {
+			return fmt.Errorf("template %q has none of {%s}", entity.template, strings.Join(entity.placeholders, "}, {"))
+		}
+	}
+	return nil
+}
+
+// UsesCategories - category tree must be loaded with SetCategories before images are built
+func (naming *Naming) UsesCategories() bool {
+	return naming.Product.Uses(PlaceholderCategoryPath) || naming.Combination.Uses(PlaceholderCategoryPath)
+}
+
+// SetCategories - build paths of categories from the category tree for every language
+func (naming *Naming) SetCategories(categories []Category) {
+	byID := make(map[int]Category, len(categories))
+	for _, category := range categories {
+		byID[category.ID] = category
+	}
+
+	naming.categoryPaths = make(map[string]map[int]string)
+	for _, variant := range naming.variants() {
+		paths := make(map[int]string, len(categories))
+		for _, category := range categories {
+			var segments []string
+			visited := make(map[int]bool)
+			for current, ok := category, true; ok && !visited[current.ID]; current, ok = byID[current.ParentID] {
+				// visited protects from cycles in broken trees
+				visited[current.ID] = true
+				segments = append([]string{naming.name(current.LocalName(variant.lang))}, segments...)
+			}
+			paths[category.ID] = strings.Join(segments, "/")
+		}
+		naming.categoryPaths[variant.lang] = paths
+	}
+}
+
+// variants - main tree with names in the chosen language and link trees of other languages
+func (naming *Naming) variants() []variant {
+	variants := []variant{{lang: naming.lang}}
+	for _, lang := range naming.treeLangs {
+		variants = append(variants, variant{lang: lang, root: path.Join(LangTreesDir, lang)})
+	}
+	return variants
+}
+
+// TreeRoots - top level dirs of language trees for the template root
+func (naming *Naming) TreeRoots(root string) []string {
+	var roots []string
+	for _, lang := range naming.treeLangs {
+		roots = append(roots, path.Join(LangTreesDir, lang, root))
+	}
+	return roots
+}
+
+// categoryPathsOf - category paths of product images, a single empty path when templates don't use categories
+func (naming *Naming) categoryPathsOf(product Product, lang string) []string {
+	if !naming.UsesCategories() {
+		return []string{""}
+	}
+	return naming.productCategoryPaths(product, naming.categoryPaths[lang])
+}
+
+// productCategoryPaths - category paths to place product images to, the first one is the main one.
+// Other paths are returned only in links mode for products of several categories.
+func (naming *Naming) productCategoryPaths(product Product, categoryPaths map[int]string) []string {
+	var paths []string
+	if categoryPath, ok := categoryPaths[product.DefaultCategoryID]; ok {
+		paths = append(paths, categoryPath)
+	}
+	for _, categoryID := range product.CategoryIds {
+		categoryPath, ok := categoryPaths[categoryID]
+		if ok && !slices.Contains(paths, categoryPath) {
+			paths = append(paths, categoryPath)
+		}
+	}
+
+	switch {
+	case len(paths) == 0:
+		return []string{UncategorizedDir}
+	case len(paths) == 1 || naming.multiCategory == MultiCategoryLinks:
+		return paths
+	case naming.multiCategory == MultiCategoryUncategorized:
+		return []string{UncategorizedDir}
+	default:
+		return paths[:1]
+	}
+}
+
+// productSku - SKU of the product for paths, p{id} when it is empty or already used by another product.
+// Products are walked in catalog order, so the first product keeps the SKU. Owners are known only
+// within the process, so SKU paths are not disjoint between shards. Empty when templates don't use SKUs.
+func (naming *Naming) productSku(product Product) string {
+	if !naming.UsesSkus() {
+		// don't keep SKU owners of the whole catalog when paths don't use them
+		return ""
+	}
+
+	fallback := fmt.Sprintf("p%d", product.ID)
+
+	sku := skuValue(product.Sku)
+	if sku == "" {
+		return fallback
+	}
+
+	naming.mutex.Lock()
+	defer naming.mutex.Unlock()
+
+	key := strings.ToLower(sku)
+	owner, ok := naming.productSkus[key]
+	if !ok {
+		naming.productSkus[key] = product.ID
+		return sku
+	}
+	if owner != product.ID {
+		return fallback
+	}
+	return sku
+}
+
+// name - product or category name for paths, transliterated to ASCII when enabled
+func (naming *Naming) name(name string) string {
+	if naming.transliterate {
+		name = Transliterate(name)
+	}
+	return sanitizeFilename(name)
+}
+
+// options - selected options of the combination like color_red-size_xl, c{number} when it has no options
+func (naming *Naming) options(combination ProductCombination, lang string) string {
+	var parts []string
+	for _, option := range combination.Options {
+		if option.Name == "" || option.Value == "" {
+			continue
+		}
+		part := naming.name(option.LocalName(lang)) + "_" + naming.name(option.LocalValue(lang))
+		parts = append(parts, strings.ToLower(part))
+	}
+
+	if len(parts) == 0 {
+		return fmt.Sprintf("c%d", combination.CombinationNumber)
+	}
+	return strings.Join(parts, "-")
+}
+
+// skuValue - SKU without chars not allowed in file names
+func skuValue(sku string) string {
+	return invalidChars.ReplaceAllString(strings.TrimSpace(sku), "")
+}
+
+// place - image with path rendered for each category path, same URL in several categories becomes
+// duplicate images which are created as links by deduplication
+func (naming *Naming) place(image Image, template *Template, root string, categoryPaths []string, values map[string]string) []Image {
+	images := make([]Image, 0, len(categoryPaths))
+	for _, categoryPath := range categoryPaths {
+		values[PlaceholderCategoryPath] = categoryPath
+		placed := image
+		naming.apply(&placed, template, root, values)
+		images = append(images, placed)
+	}
+	return images
+}
+
+// apply - render template in the root dir and set dir and file name of the image, every path segment is made portable
+// by the file name policy and truncated to the file name length limit keeping the extension
+func (naming *Naming) apply(image *Image, template *Template, root string, values map[string]string) {
+	values[PlaceholderExt] = URLExtension(image.URL)
+
+	rendered := template.Render(values)
+	if root != "" {
+		// not path.Join, it would clean .. before segments are checked
+		rendered = root + "/" + rendered
+	}
+
+	segments := strings.Split(rendered, "/")
+	for i, segment := range segments {
+		segments[i] = portableSegment(naming.policy, segment, i == len(segments)-1)
+	}
+
+	image.Dir = strings.Join(segments[:len(segments)-1], "/")
+	image.FileName = segments[len(segments)-1]
+}
+
+// maxExtensionLength - longer suffixes after the last dot are a part of the name, not an extension
+const maxExtensionLength = 16
+
+// URLExtension - lowercase extension of the file in URL without dot, jpg if there is no one
+func URLExtension(imageURL string) string {
+	parsed, err := url.Parse(imageURL)
+	if err != nil {
+		return "jpg"
+	}
+
+	extension := strings.ToLower(strings.TrimPrefix(path.Ext(parsed.Path), "."))
+	if extension == "" || len(extension) > 4 {
+		return "jpg"
+	}
+
+	return extension
+}
@@ -0,0 +1,215 @@
+package api
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTemplateErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		err      string
+	}{
+		{"unknown placeholder", "products/{product}.jpg", "unknown placeholder {product}"},
+		{"category placeholder in product template", "products/{category_id}.jpg", "unknown placeholder {category_id}"},
+		{"unclosed brace", "products/{product_id.jpg", "unmatched brace"},
+		{"unopened brace", "products/product_id}.jpg", "unmatched brace"},
+		{"upper case placeholder", "products/{PRODUCT_ID}.jpg", "unmatched brace"},
+		{"no placeholders", "products/image.jpg", "no placeholders"},
+		{"parent dir", "../products/{product_id}.jpg", "path segments are not allowed"},
+		{"parent dir in the middle", "products/../../{product_id}.jpg", "path segments are not allowed"},
+		{"current dir", "products/./{product_id}.jpg", "path segments are not allowed"},
+		{"empty segment", "products//{product_id}.jpg", "path segments are not allowed"},
+		{"absolute path", "/var/www/{product_id}.jpg", "relative"},
+		{"dir instead of file", "products/{product_id}/", "relative"},
+		{"backslash separator", `products\{product_id}.jpg`, "use / as path separator"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseTemplate(test.template, productPlaceholders)
+			if err == nil {
+				t.Fatalf("ParseTemplate(%q) succeeded, want error containing %q", test.template, test.err)
+			}
+			if !strings.Contains(err.Error(), test.err) {
+				t.Errorf("ParseTemplate(%q) error %q, want it to contain %q", test.template, err, test.err)
+			}
+		})
+	}
+}
+
+func TestTemplateRender(t *testing.T) {
+	values := map[string]string{
+		PlaceholderProductID: "123",
+		PlaceholderImageID:   "456",
+		PlaceholderPosition:  "7",
+		PlaceholderName:      "a/b:c",
+		PlaceholderExt:       "png",
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{"default", DefaultProductTemplate, "products/p123-456.jpg"},
+		{"zero padding", "products/p{product_id}-{position:02}.jpg", "products/p123-07.jpg"},
+		{"padding shorter than value", "products/{product_id:2}.jpg", "products/123.jpg"},
+		{"wide padding", "{product_id:06}/{position:3}.{ext}", "000123/007.png"},
+		{"separators removed from values", "products/{name}.jpg", "products/abc.jpg"},
+		{"repeated placeholder", "{product_id}/{product_id}-{image_id}.jpg", "123/123-456.jpg"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			template, err := ParseTemplate(test.template, productPlaceholders)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := template.Render(values); got != test.want {
+				t.Errorf("Render(%q) = %q, want %q", test.template, got, test.want)
+			}
+		})
+	}
+}
+
+func TestTemplateRoot(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{DefaultProductTemplate, "products"},
+		{"images/products/{product_id}.jpg", "images"},
+		{"{sku}/{position}.jpg", ""},
+		{"p{product_id}.jpg", ""},
+	}
+
+	for _, test := range tests {
+		template, err := ParseTemplate(test.template, productPlaceholders)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := template.Root(); got != test.want {
+			t.Errorf("Root(%q) = %q, want %q", test.template, got, test.want)
+		}
+	}
+}
+
+func TestNamingApplyStaysInDownloadDir(t *testing.T) {
+	tests := []struct {
+		name        string
+		placeholder string
+		value       string
+		want        string
+	}{
+		{"parent dir", PlaceholderSku, "..", "products/_/p1.jpg"},
+		{"parent dir with separators", PlaceholderSku, "../../etc", "products/....etc/p1.jpg"},
+		{"absolute path", PlaceholderSku, "/etc/passwd", "products/etcpasswd/p1.jpg"},
+		{"backslashes", PlaceholderSku, `..\..\windows`, "products/....windows/p1.jpg"},
+		{"current dir", PlaceholderSku, ".", "products/_/p1.jpg"},
+		{"category path with parent dirs", PlaceholderCategoryPath, "../../etc", "products/_/_/etc/p1.jpg"},
+		{"absolute category path", PlaceholderCategoryPath, "/etc", "products/_/etc/p1.jpg"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			naming, err := CreateNaming(NamingID, LayoutFlat, MultiCategoryDefault, "products/{"+test.placeholder+"}/p{product_id}.jpg", "", "", false, false, PolicyPOSIX, "", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			image := Image{URL: "https://example.com/image.jpg"}
+			naming.apply(&image, naming.Product, "", map[string]string{
+				test.placeholder:     test.value,
+				PlaceholderProductID: "1",
+			})
+			if got := image.Path(); got != test.want {
+				t.Errorf("path for %q = %q, want %q", test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func TestTemplateMatches(t *testing.T) {
+	tests := []struct {
+		template string
+		path     string
+		want     bool
+	}{
+		{DefaultCombinationTemplate, "products/p1-c2.jpg", true},
+		{DefaultCombinationTemplate, "products/P1-C2.JPG", true},
+		{DefaultCombinationTemplate, "products/p1-c2-2.jpg", true},
+		{DefaultCombinationTemplate, "products/p1-101.jpg", false},
+		{DefaultCombinationTemplate, "categories/p1-c2.jpg", false},
+		{"products/{category_path}/p{product_id}-c{combination_number}.jpg", "products/shoes/boots/p1-c2.jpg", true},
+	}
+
+	for _, test := range tests {
+		template, err := ParseTemplate(test.template, combinationPlaceholders)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := template.Matches(test.path); got != test.want {
+			t.Errorf("Matches(%q, %q) = %v, want %v", test.template, test.path, got, test.want)
+		}
+	}
+}
+
+func TestNamingEntityUnique(t *testing.T) {
+	tests := []struct {
+		name                string
+		mode                string
+		productTemplate     string
+		combinationTemplate string
+		includeNames        bool
+		unique              bool
+	}{
+		{"default", NamingID, "", "", false, true},
+		{"names with IDs", NamingID, "", "", true, true},
+		{"options", NamingOptions, "", "", false, true},
+		{"sku", NamingSku, "", "", false, false},
+		{"sku with product ID", NamingSku, "products/{sku}-p{product_id}-{position}.jpg", "products/{sku}-{combination_id}.jpg", false, true},
+		{"names only", NamingID, "products/{name}.{ext}", "", true, false},
+		{"combination number only", NamingID, "", "products/c{combination_number}.jpg", false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			naming, err := CreateNaming(test.mode, LayoutFlat, MultiCategoryDefault, test.productTemplate, test.combinationTemplate, "", test.includeNames, false, PolicyPOSIX, "", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := naming.EntityUnique(); (err == nil) != test.unique {
+				t.Errorf("EntityUnique() = %v, want unique %v", err, test.unique)
+			}
+		})
+	}
+}
+
+func TestProductSkuRegistry(t *testing.T) {
+	tests := []struct {
+		mode string
+		want int
+	}{
+		{NamingID, 0},
+		{NamingOptions, 0},
+		{NamingSku, 2},
+	}
+
+	for _, test := range tests {
+		naming, err := CreateNaming(test.mode, LayoutFlat, MultiCategoryDefault, "", "", "", false, false, PolicyPOSIX, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for id, sku := range []string{"TEE", "SHIRT", "TEE"} {
+			product := Product{ID: id + 1, Sku: sku}
+			product.Images(naming)
+			product.CombinationImages([]ProductCombination{{ID: 1, CombinationNumber: 1, Sku: sku + "-1", ImageUrl: "https://example.com/1.jpg"}}, naming)
+		}
+		if got := len(naming.productSkus); got != test.want {
+			t.Errorf("%s naming registered %d SKUs, want %d", test.mode, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// File name policies
+const (
+	PolicyPOSIX   = "posix"
+	PolicyWindows = "windows"
+	PolicyASCII   = "ascii"
+)
+
+var (
+	windowsInvalidChars = regexp.MustCompile(`[<>:"\\|?*\x00-\x1F]`)
+	nonPortableChars    = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+)
+
+// windowsReservedNames - device names which can't be used as file names on Windows, even with extension
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// ValidPolicy - policy name is known
+func ValidPolicy(policy string) bool {
+	return policy == PolicyPOSIX || policy == PolicyWindows || policy == PolicyASCII
+}
+
+// portableSegment - path segment made safe by the policy and truncated to the file name length limit.
+// posix keeps names as is, windows normalizes Unicode to NFC, replaces chars forbidden on Windows,
+// trims trailing dots and spaces and escapes reserved device names, ascii also transliterates names
+// and replaces everything except latin letters, digits, dot, dash and underscore.
+func portableSegment(policy string, segment string, isFile bool) string {
+	if policy != PolicyPOSIX {
+		segment = windowsInvalidChars.ReplaceAllString(norm.NFC.String(segment), "_")
+	}
+
+	if policy == PolicyASCII {
+		segment = nonPortableChars.ReplaceAllString(Transliterate(segment), "_")
+	}
+
+	extension := ""
+	if isFile {
+		extension = path.Ext(segment)
+		if len(extension) > maxExtensionLength {
+			extension = ""
+		}
+	}
+	segment = TruncateFilename(strings.TrimSuffix(segment, extension), extension)
+
+	if policy != PolicyPOSIX {
+		segment = strings.TrimRight(segment, ". ")
+
+		base, rest, _ := strings.Cut(segment, ".")
+		if windowsReservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+			segment = base + "_"
+			if rest != "" {
+				segment += "." + rest
+			}
+		}
+	}
+
+	if segment == "" || segment == "." || segment == ".." {
+		// never leave the parent dir
+		return "_"
+	}
+
+	return segment
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPortableSegment(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		segment string
+		isFile  bool
+		want    string
+	}{
+		{"posix keeps name", PolicyPOSIX, "Товар_1.jpg", true, "Товар_1.jpg"},
+		{"posix keeps trailing dot", PolicyPOSIX, "Shoes.", false, "Shoes."},
+		{"posix keeps reserved name", PolicyPOSIX, "CON.jpg", true, "CON.jpg"},
+		{"posix parent dir", PolicyPOSIX, "..", false, "_"},
+		{"empty segment", PolicyPOSIX, "", false, "_"},
+		{"windows reserved name", PolicyWindows, "CON", false, "CON_"},
+		{"windows reserved name with extension", PolicyWindows, "nul.jpg", true, "nul_.jpg"},
+		{"windows reserved port", PolicyWindows, "Com1.tar.gz", true, "Com1_.tar.gz"},
+		{"windows name starting with reserved", PolicyWindows, "CONSOLE.jpg", true, "CONSOLE.jpg"},
+		{"windows trailing dots and spaces", PolicyWindows, "Shoes. . ", false, "Shoes"},
+		{"windows only dots", PolicyWindows, "...", false, "_"},
+		{"windows forbidden chars", PolicyWindows, `a:b|c?.jpg`, true, "a_b_c_.jpg"},
+		{"windows NFC", PolicyWindows, "Crème_Brûlée.jpg", true, "Crème_Brûlée.jpg"},
+		{"windows NFC cyrillic", PolicyWindows, "Ёлка_йод", false, "Ёлка_йод"},
+		{"ascii transliteration", PolicyASCII, "p1-Щётка_Ёжик.jpg", true, "p1-Shchyotka_Yozhik.jpg"},
+		{"ascii decomposed letters", PolicyASCII, "Crème", false, "Creme"},
+		{"ascii other chars", PolicyASCII, "日本 (new)&co.png", true, "____new__co.png"},
+		{"ascii reserved name", PolicyASCII, "aux.jpg", true, "aux_.jpg"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := portableSegment(test.policy, test.segment, test.isFile); got != test.want {
+				t.Errorf("portableSegment(%q, %q) = %q, want %q", test.policy, test.segment, got, test.want)
+			}
+		})
+	}
+}
+
+func TestPortableSegmentLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		segment string
+		isFile  bool
+		suffix  string
+	}{
+		{"cyrillic file", PolicyPOSIX, strings.Repeat("Я", 200) + ".jpg", true, "Я.jpg"},
+		{"ascii grows by transliteration", PolicyASCII, strings.Repeat("Щ", 100) + ".jpg", true, "Shc.jpg"},
+		{"windows trailing space after cut", PolicyWindows, strings.Repeat("a", 254) + " " + strings.Repeat("b", 10), false, "aa"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := portableSegment(test.policy, test.segment, test.isFile)
+			if len(got) > maxFilenameLength {
+				t.Errorf("length %d exceeds %d", len(got), maxFilenameLength)
+			}
+			if !strings.HasSuffix(got, test.suffix) {
+				t.Errorf("%q does not end with %q", got, test.suffix)
+			}
+		})
+	}
+}
+
+func TestPortableSegmentNFC(t *testing.T) {
+	tests := []struct {
+		name    string
+		segment string
+		want    string
+	}{
+		{"plain", "plain", "plain"},
+		{"latin", "Cre\u0300me", "Cr\u00e8me"},
+		{"latin with two marks", "u\u0308\u0304", "\u01d6"},
+		{"cyrillic", "\u0438\u0306", "\u0439"},
+		{"greek", "\u03b1\u0301", "\u03ac"},
+		{"kana with dakuten", "\u304b\u3099\u30cf\u309a", "\u304c\u30d1"},
+		{"hangul jamo", "\u1112\u1161\u11ab\u1100\u1173\u11af", "\ud55c\uae00"},
+		{"mark without precomposed letter", "q\u0301", "q\u0301"},
+		{"lone mark", "\u0301", "\u0301"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := portableSegment(PolicyWindows, test.segment, false); got != test.want {
+				t.Errorf("portableSegment(%q) = %q, want %q", test.segment, got, test.want)
+			}
+		})
+	}
+}
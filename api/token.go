@@ -18,6 +18,10 @@ func RetrievePublicToken(httpClient *http.Client, storeId int64) string {
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
 
+	if err := apiLimiter.Wait(ctx); err != nil {
+		return ""
+	}
+
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
 	if err != nil {
 		return ""
@@ -0,0 +1,57 @@
+package api
+
+import "strings"
+
+// transliterations - ASCII replacements of Cyrillic, Greek and accented Latin letters
+var transliterations = map[rune]string{}
+
+func init() {
+	tables := []string{
+		// Cyrillic, Russian
+		"а a б b в v г g д d е e ё yo ж zh з z и i й y к k л l м m н n о o п p р r с s т t у u ф f х kh ц ts ч ch ш sh щ shch ъ _ ы y ь _ э e ю yu я ya",
+		// Cyrillic, Ukrainian and Belarusian
+		"є ye і i ї yi ґ g ў u",
+		// Greek
+		"α a β v γ g δ d ε e ζ z η i θ th ι i κ k λ l μ m ν n ξ x ο o π p ρ r σ s ς s τ t υ y φ f χ ch ψ ps ω o " +
+			"ά a έ e ή i ί i ό o ύ y ώ o ϊ i ϋ y ΐ i ΰ y",
+		// Latin with diacritics
+		"à a á a â a ã a ä a å a ā a ă a ą a æ ae ç c ć c č c ĉ c ċ c ď d đ d è e é e ê e ë e ē e ĕ e ė e ę e ě e " +
+			"ĝ g ğ g ġ g ģ g ĥ h ħ h ì i í i î i ï i ĩ i ī i ĭ i į i ı i ĵ j ķ k ĺ l ļ l ľ l ŀ l ł l ñ n ń n ņ n ň n " +
+			"ò o ó o ô o õ o ö o ø o ō o ŏ o ő o œ oe ŕ r ŗ r ř r ś s ŝ s ş s š s ș s ß ss ţ t ť t ŧ t ț t " +
+			"ù u ú u û u ü u ũ u ū u ŭ u ů u ű u ų u ŵ w ý y ÿ y ŷ y ź z ż z ž z ð d þ th",
+	}
+
+	for _, table := range tables {
+		fields := strings.Fields(table)
+		for i := 0; i+1 < len(fields); i += 2 {
+			letter := []rune(fields[i])[0]
+			replacement := strings.ReplaceAll(fields[i+1], "_", "")
+			transliterations[letter] = replacement
+
+			// capital letter keeps the case of the first replacement letter, signs like Ъ are dropped as well
+			upper := []rune(strings.ToUpper(fields[i]))
+			if len(upper) == 1 && upper[0] != letter {
+				if _, ok := transliterations[upper[0]]; !ok {
+					capital := replacement
+					if capital != "" {
+						capital = strings.ToUpper(capital[:1]) + capital[1:]
+					}
+					transliterations[upper[0]] = capital
+				}
+			}
+		}
+	}
+}
+
+// Transliterate - replace Cyrillic, Greek and accented Latin letters with ASCII, other chars are kept
+func Transliterate(text string) string {
+	var result strings.Builder
+	for _, letter := range text {
+		if replacement, ok := transliterations[letter]; ok {
+			result.WriteString(replacement)
+		} else {
+			result.WriteRune(letter)
+		}
+	}
+	return result.String()
+}
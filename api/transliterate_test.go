@@ -0,0 +1,63 @@
+package api
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTransliterate(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"Товар", "Tovar"},
+		{"объём", "obyom"},
+		{"ОБЪЁМ", "OBYoM"},
+		{"Подъезд Ь", "Podezd "},
+		{"Щука", "Shchuka"},
+		{"Їжак ґанок", "Yizhak ganok"},
+		{"Αθήνα", "Athina"},
+		{"Crème brûlée", "Creme brulee"},
+		{"Straße Øre", "Strasse Ore"},
+		{"shoes 42-44", "shoes 42-44"},
+		{"日本", "日本"},
+	}
+
+	for _, test := range tests {
+		if got := Transliterate(test.text); got != test.want {
+			t.Errorf("Transliterate(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestTruncateFilename(t *testing.T) {
+	tests := []struct {
+		name   string
+		base   string
+		suffix string
+		want   string
+	}{
+		{"short name", "tee", "-2.jpg", "tee-2.jpg"},
+		{"exact limit", strings.Repeat("a", 249), "-2.jpg", strings.Repeat("a", 249) + "-2.jpg"},
+		{"ascii cut", strings.Repeat("a", 300), ".jpg", strings.Repeat("a", 251) + ".jpg"},
+		// 2 bytes per letter, 251 bytes are left for the name, so the last letter doesn't fit
+		{"cut on rune boundary", strings.Repeat("я", 200), ".jpg", strings.Repeat("я", 125) + ".jpg"},
+		{"cut on wide rune boundary", "a" + strings.Repeat("日", 100), ".jpg", "a" + strings.Repeat("日", 83) + ".jpg"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := TruncateFilename(test.base, test.suffix)
+			if got != test.want {
+				t.Errorf("TruncateFilename() = %q, want %q", got, test.want)
+			}
+			if len(got) > maxFilenameLength {
+				t.Errorf("TruncateFilename() length %d, want at most %d", len(got), maxFilenameLength)
+			}
+			if !utf8.ValidString(got) || !strings.HasSuffix(got, test.suffix) {
+				t.Errorf("TruncateFilename() = %q, want valid UTF-8 ending with %q", got, test.suffix)
+			}
+		})
+	}
+}
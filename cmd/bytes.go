@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// byteSize - flag value with optional K, M, G suffix (powers of 1024), e.g. 500K or 1.5M
+type byteSize int64
+
+func (size *byteSize) String() string {
+	for _, unit := range []struct {
+		suffix string
+		value  int64
+	}{{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if *size != 0 && int64(*size)%unit.value == 0 {
+			return strconv.FormatInt(int64(*size)/unit.value, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(int64(*size), 10)
+}
+
+func (size *byteSize) Set(value string) error {
+	parsed, err := parseByteSize(value)
+	if err != nil {
+		return err
+	}
+	*size = byteSize(parsed)
+	return nil
+}
+
+func parseByteSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	value = strings.TrimSuffix(value, "B")
+
+	multiplier := int64(1)
+	if value != "" {
+		switch value[len(value)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			value = value[:len(value)-1]
+		}
+	}
+
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected number with optional K, M, G or T suffix", value)
+	}
+
+	return int64(number * float64(multiplier)), nil
+}
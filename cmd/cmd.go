@@ -4,52 +4,191 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/turchenkoalex/ecwid-images-downloader/api"
 )
 
 type Options struct {
-	StoreID         int64
-	Parallelism     int
-	FetchLimit      int
-	SkipProducts    bool
-	SkipCategories  bool
-	UseCombinations bool
-	Verbose         bool
-	DownloadDir     string
-	SkipDownloaded  bool
-	IncludeNames    bool
-	Token           string
+	StoreID                 int64
+	Parallelism             int
+	MinParallelism          int
+	MaxParallelism          int
+	AdaptiveParallelism     bool
+	CombinationsParallelism int
+	FetchLimit              int
+	SkipProducts            bool
+	SkipCategories          bool
+	UseCombinations         bool
+	Verbose                 bool
+	DownloadDir             string
+	SkipDownloaded          bool
+	RefreshUpdated          bool
+	IncludeNames            bool
+	NamingMode              string
+	Layout                  string
+	MultiCategory           string
+	Collisions              string
+	FileTimes               string
+	Sidecars                string
+	Transliterate           bool
+	FilenamePolicy          string
+	Lang                    string
+	LangTrees               string
+	ProductTemplate         string
+	CombinationTemplate     string
+	CategoryTemplate        string
+	Naming                  *api.Naming
+	Token                   string
+	QueueSize               int
+	Retries                 int
+	RetryBackoff            time.Duration
+	FailuresFile            string
+	RetryFailed             bool
+	Dedup                   string
+	Storage                 string
+	ObjectsLink             string
+	CollectGarbage          bool
+	DryRun                  bool
+	PlanFile                string
+	EstimateSize            bool
+	ExecutePlan             string
+	Input                   string
+	Shard                   Shard
+	Merge                   string
+	InputFormat             string
+	Mirror                  bool
+	MirrorDryRun            bool
+	MirrorTrash             string
+
+	APIRateLimit float64
+	APIBurst     int
+	CDNRateLimit float64
+	CDNBurst     int
+
+	MaxBandwidth      int64
+	MinFreeSpace      int64
+	Preflight         string
+	PreflightSample   int
+	BandwidthSchedule string
+
+	ConnectTimeout     time.Duration
+	APITimeout         time.Duration
+	ImageHeaderTimeout time.Duration
+	ImageIdleTimeout   time.Duration
 }
 
 var options Options
 
+const defaultFailuresFile = "failures.jsonl"
+
 func init() {
 	flag.Int64Var(&options.StoreID, "store", 0, "Store ID")
-	flag.IntVar(&options.Parallelism, "parallelism", 5, "Download parallelism")
+	flag.IntVar(&options.Parallelism, "parallelism", 5, "Download parallelism (initial value in adaptive mode)")
+	flag.IntVar(&options.MinParallelism, "min-parallelism", 1, "Min download parallelism in adaptive mode")
+	flag.IntVar(&options.MaxParallelism, "max-parallelism", 50, "Max download parallelism")
+	flag.BoolVar(&options.AdaptiveParallelism, "adaptive-parallelism", false, "Adjust download parallelism by throughput, latency and error rate")
+	flag.IntVar(&options.CombinationsParallelism, "combinations-parallelism", 5, "Parallel combination requests")
+	flag.IntVar(&options.QueueSize, "queue-size", 100, "Max images waiting in the download queue")
 	flag.IntVar(&options.FetchLimit, "limit", 100, "API v3 fetch limit")
 	flag.BoolVar(&options.UseCombinations, "use-combinations", false, "Download combination images")
 	flag.BoolVar(&options.Verbose, "verbose", false, "Detailed logs")
 	flag.BoolVar(&options.SkipDownloaded, "skip-downloaded", false, "Skip images already present on disk")
+	flag.BoolVar(&options.RefreshUpdated, "refresh-updated", false, "Skip images already present on disk, but download again images whose product or category was updated after the file was written (needs -file-times updated or off)")
 	flag.BoolVar(&options.SkipProducts, "skip-products", false, "Skip product images")
 	flag.BoolVar(&options.SkipCategories, "skip-categories", false, "Skip categories images")
-	flag.BoolVar(&options.IncludeNames, "include-names", false, "Use product names in image file names")
-	flag.StringVar(&options.DownloadDir, "download-dir", "", "Dir for download images (default: downloads/storeId)")
+	flag.BoolVar(&options.IncludeNames, "include-names", false, "Use product names in image file names (adds -{name} to default path templates)")
+	flag.StringVar(&options.NamingMode, "naming", api.NamingID, "Default file names: id (product and combination IDs), sku (product and combination SKUs, IDs when SKU is empty or repeats) or options (combination option values, e.g. p123-color_red-size_xl)")
+	flag.StringVar(&options.Layout, "layout", api.LayoutFlat, "Default folders of product images: flat (all in products/) or categories (products/{category_path}/ of the default category)")
+	flag.StringVar(&options.MultiCategory, "multi-category", api.MultiCategoryDefault, "Products of several categories are placed to: default (default category only), links (every category, requires -dedup) or uncategorized")
+	flag.BoolVar(&options.Transliterate, "transliterate", false, "Transliterate Cyrillic, Greek and accented Latin letters of names in file names to ASCII")
+	flag.StringVar(&options.FilenamePolicy, "filename-policy", api.PolicyPOSIX, "File names policy: posix (as is), windows (safe for Windows and macOS) or ascii (latin letters, digits, dot, dash and underscore only)")
+	flag.StringVar(&options.Lang, "lang", "", "Language of product and category names in file names, e.g. de (default name when there is no translation)")
+	flag.StringVar(&options.LangTrees, "lang-trees", "", "Comma separated languages to create lang/{code}/ trees of links with translated names, e.g. en,de (requires -dedup)")
+	flag.StringVar(&options.FileTimes, "file-times", fileTimesLastModified, "Modification time of downloaded files: last-modified (Last-Modified header, product or category update time without it), updated (product or category update time) or off (time of download)")
+	flag.StringVar(&options.Sidecars, "sidecars", sidecarsOff, "Write catalog metadata as JSON next to downloaded images: image (image.json for each image), product (p{id}.json for each product) or off")
+	flag.StringVar(&options.Collisions, "collisions", collisionsSuffix, "Different images with the same path (case-insensitive): suffix (add -2, -3), id (add product or category ID) or fail (stop the run)")
+	flag.StringVar(&options.ProductTemplate, "product-template", "", "Path template of product images (default \""+api.DefaultProductTemplate+"\", with -naming sku \""+api.SkuProductTemplate+"\")")
+	flag.StringVar(&options.CombinationTemplate, "combination-template", "", "Path template of combination images (default \""+api.DefaultCombinationTemplate+"\", with -naming sku \""+api.SkuCombinationTemplate+"\", with -naming options \""+api.OptionsCombinationTemplate+"\")")
+	flag.StringVar(&options.CategoryTemplate, "category-template", "", "Path template of category images (default \""+api.DefaultCategoryTemplate+"\")")
+	flag.StringVar(&options.DownloadDir, "download-dir", "", "Dir for download images (default: downloads/storeId or downloads with -input)")
 	flag.StringVar(&options.Token, "token", "", "Token to access API v3 (if not provided, will try to retrieve public token)")
+	flag.StringVar(&options.Dedup, "dedup", linkModeHardlink, "Download each image URL once and create other files with the same URL as: hardlink, copy or off")
+	flag.StringVar(&options.Storage, "storage", storageFiles, "Storage mode: files or objects (each unique image stored once in objects/ by content hash, products/ and categories/ contain links)")
+	flag.StringVar(&options.ObjectsLink, "objects-link", linkModeHardlink, "Links to objects in objects storage mode: hardlink or symlink")
+	flag.BoolVar(&options.CollectGarbage, "gc", false, "Walk the catalog and remove objects not referenced by it, nothing is downloaded (objects storage mode, requires -use-combinations)")
+	flag.BoolVar(&options.DryRun, "dry-run", false, "Walk the catalog and list images which would be downloaded, nothing is downloaded")
+	flag.StringVar(&options.PlanFile, "plan-file", "", "Write dry-run plan to this file as JSON Lines instead of printing it")
+	flag.BoolVar(&options.EstimateSize, "estimate-size", false, "Request size of each image with HEAD in dry-run mode")
+	flag.StringVar(&options.ExecutePlan, "execute", "", "Download exactly the images from this plan file written by -plan-file, the API is not used and paths are not renamed on collisions")
+	flag.StringVar(&options.Input, "input", "", "Download images listed in JSON Lines or CSV file (url and path of each image), - for stdin. Store ID and token are not needed")
+	flag.StringVar(&options.InputFormat, "input-format", inputFormatAuto, "Format of -input: auto (by file extension), jsonl or csv")
+	flag.Var(&options.Shard, "shard", "Process only part k of n of the catalog, e.g. 2/5, to run several processes in parallel")
+	flag.StringVar(&options.Merge, "merge", "", "Merge plan or failures files of shards passed as arguments into this file and exit")
+	flag.BoolVar(&options.Mirror, "mirror", false, "After complete catalog walk remove local images which are no longer in the catalog")
+	flag.BoolVar(&options.MirrorDryRun, "mirror-dry-run", false, "Only list local images which are no longer in the catalog")
+	flag.StringVar(&options.MirrorTrash, "mirror-trash", "", "Move images which are no longer in the catalog to this dir instead of deleting")
+	flag.IntVar(&options.Retries, "retries", 3, "Max download attempts per image")
+	flag.DurationVar(&options.RetryBackoff, "retry-backoff", 2*time.Second, "Delay before the first retry, doubled on each next attempt")
+	flag.StringVar(&options.FailuresFile, "failures-file", defaultFailuresFile, "File in download dir to write permanently failed images to")
+	flag.BoolVar(&options.RetryFailed, "retry-failed", false, "Download only images from failures file of the previous run")
+	flag.Float64Var(&options.APIRateLimit, "api-rps", 10, "Max API v3 requests per second (0 - unlimited)")
+	flag.IntVar(&options.APIBurst, "api-burst", 10, "Max burst of API v3 requests")
+	flag.Float64Var(&options.CDNRateLimit, "cdn-rps", 0, "Max image CDN requests per second (0 - unlimited)")
+	flag.IntVar(&options.CDNBurst, "cdn-burst", 20, "Max burst of image CDN requests")
+	flag.Var((*byteSize)(&options.MaxBandwidth), "max-bandwidth", "Max total download speed in bytes per second with optional K, M, G suffix (0 - unlimited)")
+	flag.StringVar(&options.BandwidthSchedule, "bandwidth-schedule", "", "Apply -max-bandwidth only in local time windows, e.g. 09:00-18:00,20:00-22:00 (default: always)")
+	options.MinFreeSpace = 500 << 20
+	flag.Var((*byteSize)(&options.MinFreeSpace), "min-free-space", "Pause downloads while free disk space is below this size with optional K, M, G suffix (0 - don't check)")
+	flag.StringVar(&options.Preflight, "preflight", preflightWarn, "Check before start that estimated download size fits free disk space: warn, abort or off")
+	flag.IntVar(&options.PreflightSample, "preflight-sample", 20, "Number of images to request with HEAD to estimate download size")
+	flag.DurationVar(&options.ConnectTimeout, "connect-timeout", 10*time.Second, "Timeout for connection and TLS handshake")
+	flag.DurationVar(&options.APITimeout, "api-timeout", 30*time.Second, "Total timeout of a single API request")
+	flag.DurationVar(&options.ImageHeaderTimeout, "image-header-timeout", 30*time.Second, "Timeout to wait for the first byte of image response")
+	flag.DurationVar(&options.ImageIdleTimeout, "image-idle-timeout", 30*time.Second, "Abort image download when no data received during this time")
 }
 
 func ReadOptions() (Options, error) {
 	flag.Parse()
 
-	if options.StoreID == 0 {
+	// merge works with files in the current dir and needs neither store nor download dir
+	if options.Merge != "" {
+		return options, nil
+	}
+
+	if options.StoreID == 0 && options.Input == "" {
 		flag.Usage()
 		return options, fmt.Errorf("please add store argument")
 	}
 
-	if options.Parallelism < 1 {
-		options.Parallelism = 1
+	if options.MinParallelism < 1 {
+		options.MinParallelism = 1
+	}
+
+	if options.MaxParallelism < options.MinParallelism {
+		options.MaxParallelism = options.MinParallelism
 	}
 
-	if options.Parallelism > 20 {
-		options.Parallelism = 20
+	if options.Parallelism < options.MinParallelism {
+		options.Parallelism = options.MinParallelism
+	}
+
+	if options.Parallelism > options.MaxParallelism {
+		options.Parallelism = options.MaxParallelism
+	}
+
+	if options.CombinationsParallelism < 1 {
+		options.CombinationsParallelism = 1
+	}
+
+	if options.CombinationsParallelism > 20 {
+		options.CombinationsParallelism = 20
+	}
+
+	if options.QueueSize < 1 {
+		options.QueueSize = 1
 	}
 
 	if options.FetchLimit < 1 {
@@ -60,10 +199,151 @@ func ReadOptions() (Options, error) {
 		options.FetchLimit = 100
 	}
 
+	if options.Dedup != linkModeHardlink && options.Dedup != linkModeCopy && options.Dedup != dedupOff {
+		return options, fmt.Errorf("unknown -dedup mode %s, expected hardlink, copy or off", options.Dedup)
+	}
+
+	if options.Storage != storageFiles && options.Storage != storageObjects {
+		return options, fmt.Errorf("unknown -storage mode %s, expected files or objects", options.Storage)
+	}
+
+	if options.ObjectsLink != linkModeHardlink && options.ObjectsLink != linkModeSymlink {
+		return options, fmt.Errorf("unknown -objects-link mode %s, expected hardlink or symlink", options.ObjectsLink)
+	}
+
+	if options.CollectGarbage && options.Storage != storageObjects {
+		return options, fmt.Errorf("-gc is available only with -storage objects")
+	}
+
+	if options.CollectGarbage && !options.UseCombinations {
+		// objects of combination images would look unreferenced and links to them would break
+		return options, fmt.Errorf("-gc needs -use-combinations to see objects of combination images")
+	}
+
+	if options.MirrorDryRun || options.MirrorTrash != "" {
+		options.Mirror = true
+	}
+
+	if options.Preflight != preflightOff && options.Preflight != preflightWarn && options.Preflight != preflightAbort {
+		return options, fmt.Errorf("unknown -preflight mode %s, expected warn, abort or off", options.Preflight)
+	}
+
+	if options.PreflightSample < 1 {
+		options.PreflightSample = 1
+	}
+
+	naming, err := api.CreateNaming(options.NamingMode, options.Layout, options.MultiCategory, options.ProductTemplate, options.CombinationTemplate, options.CategoryTemplate, options.IncludeNames, options.Transliterate, options.FilenamePolicy, options.Lang, splitList(options.LangTrees))
+	if err != nil {
+		return options, err
+	}
+	options.Naming = naming
+
+	if options.FileTimes != fileTimesLastModified && options.FileTimes != fileTimesUpdated && options.FileTimes != fileTimesOff {
+		return options, fmt.Errorf("unknown -file-times mode %s, expected last-modified, updated or off", options.FileTimes)
+	}
+
+	if options.RefreshUpdated {
+		if options.FileTimes == fileTimesLastModified {
+			// Last-Modified of an image is usually older than the update of its product, every image would be downloaded again
+			return options, fmt.Errorf("-refresh-updated compares file times with update times, use it with -file-times updated or off")
+		}
+		options.SkipDownloaded = true
+	}
+
+	if options.Sidecars != sidecarsOff && options.Sidecars != sidecarsImage && options.Sidecars != sidecarsProduct {
+		return options, fmt.Errorf("unknown -sidecars mode %s, expected image, product or off", options.Sidecars)
+	}
+
+	if options.Collisions != collisionsSuffix && options.Collisions != collisionsID && options.Collisions != collisionsFail {
+		return options, fmt.Errorf("unknown -collisions mode %s, expected suffix, id or fail", options.Collisions)
+	}
+
+	if options.Dedup == dedupOff && options.Storage != storageObjects {
+		if options.MultiCategory == api.MultiCategoryLinks {
+			return options, fmt.Errorf("-multi-category links creates links by deduplication and can't be used with -dedup off")
+		}
+		if options.LangTrees != "" {
+			return options, fmt.Errorf("-lang-trees creates links by deduplication and can't be used with -dedup off")
+		}
+	}
+
+	if options.Mirror && len(mirrorRoots(options)) == 0 {
+		return options, fmt.Errorf("-mirror needs path templates starting with a fixed dir, e.g. products/")
+	}
+
+	if options.Shard.Enabled() {
+		if options.Mirror || options.CollectGarbage {
+			return options, fmt.Errorf("-mirror and -gc need the whole catalog and can't be used with -shard")
+		}
+
+		if err := options.Naming.EntityUnique(); err != nil {
+			// collisions are resolved only inside one process, paths of shards must not overlap by themselves
+			return options, fmt.Errorf("paths of images of different shards could be the same, -shard needs entity IDs in templates: %w", err)
+		}
+
+		if options.FailuresFile == defaultFailuresFile {
+			options.FailuresFile = "failures" + options.Shard.suffix() + ".jsonl"
+		}
+	}
+
+	if options.Retries < 1 {
+		options.Retries = 1
+	}
+
+	if options.PlanFile != "" {
+		options.DryRun = true
+
+		// plan file is relative to the current dir, not to the download dir
+		planFile, err := filepath.Abs(options.PlanFile)
+		if err != nil {
+			return options, err
+		}
+		options.PlanFile = planFile
+	}
+
+	if options.CollectGarbage && options.DryRun {
+		// -gc removes objects, a user asking for a dry run must not lose any
+		return options, fmt.Errorf("-gc removes objects and can't be combined with -dry-run or -plan-file")
+	}
+
+	if options.ExecutePlan != "" {
+		if options.DryRun || options.RetryFailed || options.Mirror || options.CollectGarbage {
+			return options, fmt.Errorf("-execute can't be combined with -dry-run, -retry-failed, -mirror or -gc")
+		}
+
+		executePlan, err := filepath.Abs(options.ExecutePlan)
+		if err != nil {
+			return options, err
+		}
+		options.ExecutePlan = executePlan
+	}
+
+	if options.Input != "" {
+		if options.DryRun || options.RetryFailed || options.ExecutePlan != "" || options.Mirror || options.CollectGarbage {
+			return options, fmt.Errorf("-input can't be combined with -dry-run, -retry-failed, -execute, -mirror or -gc")
+		}
+
+		if options.InputFormat != inputFormatAuto && options.InputFormat != inputFormatJSONL && options.InputFormat != inputFormatCSV {
+			return options, fmt.Errorf("unknown -input-format %s, expected auto, jsonl or csv", options.InputFormat)
+		}
+
+		if options.Input != "-" {
+			input, err := filepath.Abs(options.Input)
+			if err != nil {
+				return options, err
+			}
+			options.Input = input
+		}
+	}
+
 	if options.DownloadDir == "" {
-		options.DownloadDir = fmt.Sprintf("downloads/%d", options.StoreID)
+		if options.StoreID == 0 {
+			options.DownloadDir = "downloads"
+		} else {
+			options.DownloadDir = fmt.Sprintf("downloads/%d", options.StoreID)
+		}
 	}
-	err := configureDirs(options.DownloadDir)
+	err = configureDirs(options.DownloadDir)
 	if err != nil {
 		return options, err
 	}
@@ -71,6 +351,17 @@ func ReadOptions() (Options, error) {
 	return options, nil
 }
 
+// splitList - non-empty trimmed items of comma separated list
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func configureDirs(downloadDir string) error {
 	_ = os.MkdirAll(downloadDir, os.ModePerm)
 
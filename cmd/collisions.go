@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/turchenkoalex/ecwid-images-downloader/api"
+)
+
+// Collision resolution modes
+const (
+	collisionsSuffix = "suffix"
+	collisionsID     = "id"
+	collisionsFail   = "fail"
+)
+
+// Collision - image which got another path because its own one was taken by a different image
+type Collision struct {
+	Path     string
+	Resolved string
+	Image    api.Image
+	Owner    api.Image
+}
+
+// CollisionResolver - makes sure that different images of the run never share a path. Paths are compared
+// case-insensitively, so the result can be copied to case-insensitive file systems.
+type CollisionResolver struct {
+	mode     string
+	mutex    sync.Mutex
+	owners   map[string]api.Image
+	resolved []Collision
+}
+
+func CreateCollisionResolver(mode string) *CollisionResolver {
+	return &CollisionResolver{
+		mode:   mode,
+		owners: make(map[string]api.Image),
+	}
+}
+
+// Resolve - register image path, returns the image with a free path. In fail mode collision is an error.
+// The path is kept by the image registered first, catalog walk schedules images in the same order in every run.
+func (resolver *CollisionResolver) Resolve(image api.Image) (api.Image, error) {
+	if resolver == nil {
+		return image, nil
+	}
+
+	resolver.mutex.Lock()
+	defer resolver.mutex.Unlock()
+
+	key := strings.ToLower(image.Path())
+	owner, taken := resolver.owners[key]
+	if !taken || owner == image {
+		resolver.owners[key] = image
+		return image, nil
+	}
+
+	if resolver.mode == collisionsFail {
+		return image, fmt.Errorf("path collision: %s of %s is already used by %s", image.Path(), describeImage(image), describeImage(owner))
+	}
+
+	resolved := image
+	extension := path.Ext(image.FileName)
+	base := strings.TrimSuffix(image.FileName, extension)
+	if resolver.mode == collisionsID {
+		resolved.FileName = api.TruncateFilename(base, fmt.Sprintf("-%s%s", imageIdentity(image), extension))
+		base = strings.TrimSuffix(resolved.FileName, extension)
+	}
+
+	// suffix mode and ID collisions of the same entity are resolved with a number
+	for number := 2; resolver.taken(resolved); number++ {
+		resolved.FileName = api.TruncateFilename(base, fmt.Sprintf("-%d%s", number, extension))
+	}
+
+	resolver.owners[strings.ToLower(resolved.Path())] = resolved
+	resolver.resolved = append(resolver.resolved, Collision{
+		Path:     image.Path(),
+		Resolved: resolved.Path(),
+		Image:    image,
+		Owner:    owner,
+	})
+	return resolved, nil
+}
+
+func (resolver *CollisionResolver) taken(image api.Image) bool {
+	_, ok := resolver.owners[strings.ToLower(image.Path())]
+	return ok
+}
+
+// Resolved - collisions resolved by renaming, sorted by path
+func (resolver *CollisionResolver) Resolved() []Collision {
+	if resolver == nil {
+		return nil
+	}
+
+	resolver.mutex.Lock()
+	defer resolver.mutex.Unlock()
+
+	collisions := append([]Collision(nil), resolver.resolved...)
+	sort.Slice(collisions, func(i, j int) bool {
+		return collisions[i].Resolved < collisions[j].Resolved
+	})
+	return collisions
+}
+
+// PrintCollisions - list renamed images in the final report
+func PrintCollisions(collisions []Collision) {
+	if len(collisions) == 0 {
+		return
+	}
+
+	fmt.Printf("Resolved %d path collisions:\n", len(collisions))
+	for _, collision := range collisions {
+		fmt.Printf("  %s -> %s (%s, path is used by %s)\n", collision.Path, collision.Resolved, describeImage(collision.Image), describeImage(collision.Owner))
+	}
+}
+
+// imageIdentity - short ID of the image source for file names
+func imageIdentity(image api.Image) string {
+	switch image.Source {
+	case api.SourceProduct, api.SourceCombination:
+		return fmt.Sprintf("p%d-%s", image.ProductID, image.ImageID)
+	case api.SourceCategory:
+		return fmt.Sprintf("cat%d", image.CategoryID)
+	default:
+		return "dup"
+	}
+}
+
+// describeImage - image source for messages
+func describeImage(image api.Image) string {
+	switch image.Source {
+	case api.SourceProduct:
+		return fmt.Sprintf("product %d image %s", image.ProductID, image.ImageID)
+	case api.SourceCombination:
+		return fmt.Sprintf("product %d combination %s", image.ProductID, strings.TrimPrefix(image.ImageID, "c"))
+	case api.SourceCategory:
+		return fmt.Sprintf("category %d", image.CategoryID)
+	default:
+		return image.URL
+	}
+}
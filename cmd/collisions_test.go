@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/turchenkoalex/ecwid-images-downloader/api"
+)
+
+func TestCollisionResolverResolve(t *testing.T) {
+	tee := api.Image{URL: "https://example.com/1.jpg", Dir: "products", FileName: "tee.jpg", Source: api.SourceProduct, ProductID: 1, ImageID: "10"}
+	other := api.Image{URL: "https://example.com/2.jpg", Dir: "products", FileName: "tee.jpg", Source: api.SourceProduct, ProductID: 2, ImageID: "20"}
+	otherCopy := other
+	otherCopy.URL = "https://example.com/3.jpg"
+	upper := api.Image{URL: "https://example.com/4.jpg", Dir: "products", FileName: "TEE.JPG", Source: api.SourceProduct, ProductID: 3, ImageID: "30"}
+	category := api.Image{URL: "https://example.com/5.jpg", Dir: "products", FileName: "tee.jpg", Source: api.SourceCategory, CategoryID: 5}
+	otherDir := api.Image{URL: "https://example.com/6.jpg", Dir: "categories", FileName: "tee.jpg", Source: api.SourceCategory, CategoryID: 6}
+
+	tests := []struct {
+		name   string
+		mode   string
+		images []api.Image
+		want   []string
+		// index of the image which stops the run in fail mode, -1 if there is none
+		failAt int
+	}{
+		{"suffix", collisionsSuffix, []api.Image{tee, other, category}, []string{"products/tee.jpg", "products/tee-2.jpg", "products/tee-3.jpg"}, -1},
+		{"suffix ignores letter case", collisionsSuffix, []api.Image{tee, other, upper}, []string{"products/tee.jpg", "products/tee-2.jpg", "products/TEE-3.JPG"}, -1},
+		{"suffix same image twice", collisionsSuffix, []api.Image{tee, tee}, []string{"products/tee.jpg", "products/tee.jpg"}, -1},
+		{"suffix different dirs", collisionsSuffix, []api.Image{tee, otherDir}, []string{"products/tee.jpg", "categories/tee.jpg"}, -1},
+		{"id", collisionsID, []api.Image{tee, other, category}, []string{"products/tee.jpg", "products/tee-p2-20.jpg", "products/tee-cat5.jpg"}, -1},
+		{"id ignores letter case", collisionsID, []api.Image{tee, upper}, []string{"products/tee.jpg", "products/TEE-p3-30.JPG"}, -1},
+		{"id of the same entity", collisionsID, []api.Image{tee, other, otherCopy}, []string{"products/tee.jpg", "products/tee-p2-20.jpg", "products/tee-p2-20-2.jpg"}, -1},
+		{"fail", collisionsFail, []api.Image{tee, other}, []string{"products/tee.jpg"}, 1},
+		{"fail ignores letter case", collisionsFail, []api.Image{tee, upper}, []string{"products/tee.jpg"}, 1},
+		{"fail same image twice", collisionsFail, []api.Image{tee, tee, otherDir}, []string{"products/tee.jpg", "products/tee.jpg", "categories/tee.jpg"}, -1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolver := CreateCollisionResolver(test.mode)
+
+			var got []string
+			for i, image := range test.images {
+				resolved, err := resolver.Resolve(image)
+				if i == test.failAt {
+					if err == nil || !strings.Contains(err.Error(), "path collision") {
+						t.Fatalf("Resolve(%s) error = %v, want path collision", image.Path(), err)
+					}
+					break
+				}
+				if err != nil {
+					t.Fatalf("Resolve(%s) error = %v", image.Path(), err)
+				}
+				got = append(got, resolved.Path())
+			}
+
+			if strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("paths = %v, want %v", got, test.want)
+			}
+
+			renamed := 0
+			for i, path := range got {
+				if path != test.images[i].Path() {
+					renamed++
+				}
+			}
+			if collisions := resolver.Resolved(); len(collisions) != renamed {
+				t.Errorf("Resolved() = %d collisions, want %d", len(collisions), renamed)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/turchenkoalex/ecwid-images-downloader/status"
+)
+
+// ConcurrencyController - limits the number of simultaneous downloads. In adaptive mode the limit grows
+// while throughput improves and downloads are healthy, and backs off on throttling, server errors and timeouts.
+type ConcurrencyController struct {
+	minLimit int
+	maxLimit int
+	adaptive bool
+	verbose  bool
+	status   *status.Reporter
+
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+
+	// statistics of the current adjustment window
+	succeeded      int
+	failed         int
+	throttled      int
+	latency        time.Duration
+	lastThroughput float64
+	lastLatency    time.Duration
+
+	done chan interface{}
+}
+
+func CreateConcurrencyController(options Options, status *status.Reporter) *ConcurrencyController {
+	controller := &ConcurrencyController{
+		minLimit: options.MinParallelism,
+		maxLimit: options.MaxParallelism,
+		adaptive: options.AdaptiveParallelism,
+		verbose:  options.Verbose,
+		status:   status,
+		limit:    options.Parallelism,
+		done:     make(chan interface{}),
+	}
+	controller.cond = sync.NewCond(&controller.mutex)
+	if controller.adaptive {
+		status.SetConcurrency(controller.limit)
+	}
+	return controller
+}
+
+// Workers - number of download goroutines to start, in adaptive mode enough for the max limit
+func (controller *ConcurrencyController) Workers() int {
+	if controller.adaptive {
+		return controller.maxLimit
+	}
+	return controller.limit
+}
+
+// Acquire - wait for a free download slot
+func (controller *ConcurrencyController) Acquire() {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	for controller.active >= controller.limit {
+		controller.cond.Wait()
+	}
+	controller.active++
+}
+
+// Skip - free download slot which was not used for a download
+func (controller *ConcurrencyController) Skip() {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	controller.active--
+	controller.cond.Signal()
+}
+
+// Release - free download slot and account the result of the download started at given time
+func (controller *ConcurrencyController) Release(started time.Time, err error) {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	controller.active--
+	controller.latency += time.Since(started)
+
+	switch {
+	case err == nil:
+		controller.succeeded++
+	case isThrottled(err):
+		controller.throttled++
+	default:
+		controller.failed++
+	}
+
+	controller.cond.Signal()
+}
+
+// Start - adjust the limit every interval until Stop is called, does nothing when adaptive mode is off
+func (controller *ConcurrencyController) Start(interval time.Duration) {
+	if !controller.adaptive {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-controller.done:
+				return
+			case <-ticker.C:
+				controller.adjust(interval)
+			}
+		}
+	}()
+}
+
+func (controller *ConcurrencyController) Stop() {
+	close(controller.done)
+}
+
+// maxLatencyGrowth - limit doesn't grow when average latency rose more than this factor over the previous window,
+// the CDN is getting slower and more parallel downloads would only queue up
+const maxLatencyGrowth = 1.5
+
+func (controller *ConcurrencyController) adjust(interval time.Duration) {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	total := controller.succeeded + controller.failed + controller.throttled
+	if total == 0 {
+		return
+	}
+
+	throughput := float64(controller.succeeded) / interval.Seconds()
+	errorRate := float64(controller.failed) / float64(total)
+	averageLatency := controller.latency / time.Duration(total)
+
+	limit := controller.limit
+	switch {
+	case controller.throttled > 0 || errorRate > 0.1:
+		// multiplicative decrease on throttling, server errors and timeouts
+		limit = limit * 3 / 4
+	case throughput >= controller.lastThroughput*1.05 && !controller.slowerThan(averageLatency):
+		// additive increase while it makes downloads faster and latency stays healthy
+		limit++
+	case throughput < controller.lastThroughput*0.9:
+		limit--
+	}
+	limit = max(controller.minLimit, min(controller.maxLimit, limit))
+
+	if limit != controller.limit && controller.verbose {
+		fmt.Printf("Download concurrency %d -> %d (throughput %.1f images/s, latency %s, errors %d, throttled %d)\n",
+			controller.limit, limit, throughput, averageLatency.Round(time.Millisecond), controller.failed, controller.throttled)
+	}
+
+	controller.limit = limit
+	controller.lastThroughput = throughput
+	controller.lastLatency = averageLatency
+	controller.succeeded = 0
+	controller.failed = 0
+	controller.throttled = 0
+	controller.latency = 0
+
+	controller.status.SetConcurrency(limit)
+	controller.cond.Broadcast()
+}
+
+// slowerThan - average latency of the window rose too much over the previous one
+func (controller *ConcurrencyController) slowerThan(averageLatency time.Duration) bool {
+	return controller.lastLatency > 0 && float64(averageLatency) > float64(controller.lastLatency)*maxLatencyGrowth
+}
+
+// statusError - unexpected http response status
+type statusError struct {
+	code   int
+	status string
+}
+
+func (err statusError) Error() string {
+	return fmt.Sprintf("unexpected response status %s", err.status)
+}
+
+// isThrottled - server asks to slow down or can't keep up with the load
+func isThrottled(err error) bool {
+	var responseErr statusError
+	if errors.As(err, &responseErr) {
+		return responseErr.code == http.StatusTooManyRequests || responseErr.code >= http.StatusInternalServerError
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, errStalled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/turchenkoalex/ecwid-images-downloader/api"
+	"github.com/turchenkoalex/ecwid-images-downloader/status"
+)
+
+// Deduplicator - tracks image URLs scheduled in the run, so each unique URL is downloaded once and
+// other files with the same URL are made as links or copies of the downloaded one
+type Deduplicator struct {
+	mode    string
+	mutex   sync.Mutex
+	primary map[string]api.Image
+	aliases []api.Image
+}
+
+// CreateDeduplicator - mode is hardlink, copy or off, nil deduplicator downloads every image
+func CreateDeduplicator(mode string) *Deduplicator {
+	if mode == dedupOff {
+		return nil
+	}
+
+	return &Deduplicator{
+		mode:    mode,
+		primary: make(map[string]api.Image),
+	}
+}
+
+const dedupOff = "off"
+
+// Add - register image, returns false if image with the same URL is already scheduled
+func (dedup *Deduplicator) Add(image api.Image) bool {
+	if dedup == nil {
+		return true
+	}
+
+	dedup.mutex.Lock()
+	defer dedup.mutex.Unlock()
+
+	primary, ok := dedup.primary[image.URL]
+	if !ok {
+		dedup.primary[image.URL] = image
+		return true
+	}
+
+	if primary.Path() != image.Path() {
+		dedup.aliases = append(dedup.aliases, image)
+	}
+	return false
+}
+
+// Remove - forget image which was not scheduled
+func (dedup *Deduplicator) Remove(image api.Image) {
+	if dedup == nil {
+		return
+	}
+
+	dedup.mutex.Lock()
+	defer dedup.mutex.Unlock()
+
+	if primary, ok := dedup.primary[image.URL]; ok && primary.Path() == image.Path() {
+		delete(dedup.primary, image.URL)
+	}
+}
+
+// sameContent - alias made earlier still matches the source: hardlinks share the file, copies keep size
+// and modification time of the source, so a rewritten source differs from the old copy
+func sameContent(mode string, source os.FileInfo, alias os.FileInfo) bool {
+	if os.SameFile(source, alias) {
+		return true
+	}
+	return mode != linkModeHardlink && source.Size() == alias.Size() && source.ModTime().Equal(alias.ModTime())
+}
+
+// Materialize - create files of duplicated images from downloaded ones. Duplicates of images that were not
+// downloaded are returned as failed with the same error.
+func (dedup *Deduplicator) Materialize(options Options, failures []FailedImage, status *status.Reporter) []FailedImage {
+	if dedup == nil {
+		return nil
+	}
+
+	dedup.mutex.Lock()
+	defer dedup.mutex.Unlock()
+
+	failedPaths := make(map[string]string, len(failures))
+	for _, failed := range failures {
+		failedPaths[failed.Path] = failed.Error
+	}
+
+	var aliasFailures []FailedImage
+	for _, alias := range dedup.aliases {
+		source := dedup.primary[alias.URL].Path()
+
+		info, err := os.Stat(source)
+		if err != nil {
+			reason, ok := failedPaths[source]
+			if !ok {
+				reason = fmt.Sprintf("source image %s was not downloaded", source)
+			}
+			aliasFailures = append(aliasFailures, FailedImage{Image: alias, Path: alias.Path(), Error: reason})
+			continue
+		}
+
+		if options.SkipDownloaded {
+			// primary downloaded again in this run is a new file, the alias has to be made again
+			if aliasInfo, err := os.Stat(alias.Path()); err == nil && sameContent(dedup.mode, info, aliasInfo) {
+				continue
+			}
+		}
+
+		mode := dedup.mode
+		if objects != nil {
+			// link duplicate to the object itself, not to another link
+			if object, ok := objects.Lookup(alias.URL); ok {
+				source, mode = object, objects.linkMode
+			}
+		}
+
+		if err := linkFile(source, alias.Path(), mode); err != nil {
+			fmt.Printf("Error occurred while create duplicate image %s from %s: %v\n", alias.Path(), source, err)
+			aliasFailures = append(aliasFailures, FailedImage{Image: alias, Path: alias.Path(), Error: err.Error()})
+			continue
+		}
+
+		status.MarkDeduplicationSaved(info.Size())
+		if options.Verbose {
+			fmt.Printf("Duplicate image url: %s saved to file: %s from %s\n", alias.URL, alias.Path(), source)
+		}
+	}
+
+	return aliasFailures
+}
@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/turchenkoalex/ecwid-images-downloader/api"
+	"github.com/turchenkoalex/ecwid-images-downloader/status"
+)
+
+func TestMaterializeReplacesStaleAliases(t *testing.T) {
+	tests := []struct {
+		name string
+		mode string
+	}{
+		{"hardlink", linkModeHardlink},
+		{"copy", linkModeCopy},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+
+			primary := api.Image{URL: "https://example.com/1.jpg", Dir: "products", FileName: "p1-1.jpg"}
+			alias := api.Image{URL: primary.URL, Dir: "lang/en/products", FileName: "p1-1.jpg"}
+			options := Options{SkipDownloaded: true}
+
+			// previous run
+			writeTestFile(t, primary.Path(), "old", time.Unix(1000, 0))
+			if err := linkFile(primary.Path(), alias.Path(), test.mode); err != nil {
+				t.Fatal(err)
+			}
+
+			// primary downloaded again in this run, written to a new file by rename
+			writeTestFile(t, "new.tmp", "new image", time.Unix(2000, 0))
+			if err := os.Rename("new.tmp", primary.Path()); err != nil {
+				t.Fatal(err)
+			}
+
+			dedup := CreateDeduplicator(test.mode)
+			dedup.Add(primary)
+			dedup.Add(alias)
+			if failures := dedup.Materialize(options, nil, status.CreateReporter(0, 0)); len(failures) > 0 {
+				t.Fatalf("failures %v", failures)
+			}
+
+			content, err := os.ReadFile(alias.Path())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != "new image" {
+				t.Errorf("alias content %q, want content of the rewritten primary", content)
+			}
+		})
+	}
+}
+
+func TestMaterializeKeepsUpToDateAliases(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	primary := api.Image{URL: "https://example.com/1.jpg", Dir: "products", FileName: "p1-1.jpg"}
+	alias := api.Image{URL: primary.URL, Dir: "products", FileName: "p1-1-copy.jpg"}
+
+	writeTestFile(t, primary.Path(), "image", time.Unix(1000, 0))
+	if err := linkFile(primary.Path(), alias.Path(), linkModeHardlink); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(alias.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dedup := CreateDeduplicator(linkModeHardlink)
+	dedup.Add(primary)
+	dedup.Add(alias)
+	dedup.Materialize(Options{SkipDownloaded: true}, nil, status.CreateReporter(0, 0))
+
+	after, err := os.Stat(alias.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Errorf("up to date alias was made again")
+	}
+}
+
+func writeTestFile(t *testing.T, fileName string, content string, modified time.Time) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(fileName), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fileName, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(fileName, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,222 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/turchenkoalex/ecwid-images-downloader/api"
+	"github.com/turchenkoalex/ecwid-images-downloader/status"
+)
+
+const (
+	preflightOff   = "off"
+	preflightWarn  = "warn"
+	preflightAbort = "abort"
+)
+
+// diskMonitor - pauses downloads while free space is low, nil means no monitoring
+var diskMonitor *DiskMonitor
+
+// DiskMonitor - periodically checks free space of the download dir
+type DiskMonitor struct {
+	minFree  int64
+	interval time.Duration
+	low      atomic.Bool
+	done     chan interface{}
+}
+
+// StartDiskMonitor - check free space every interval and pause downloads when it is below -min-free-space
+func StartDiskMonitor(options Options, interval time.Duration) *DiskMonitor {
+	if options.MinFreeSpace <= 0 {
+		return nil
+	}
+
+	monitor := &DiskMonitor{
+		minFree:  options.MinFreeSpace,
+		interval: interval,
+		done:     make(chan interface{}),
+	}
+	monitor.check()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-monitor.done:
+				return
+			case <-ticker.C:
+				monitor.check()
+			}
+		}
+	}()
+
+	diskMonitor = monitor
+	return monitor
+}
+
+func (monitor *DiskMonitor) check() {
+	free, err := freeSpace(".")
+	if err != nil {
+		// can't check, don't block downloads
+		return
+	}
+
+	low := free < monitor.minFree
+	if monitor.low.Swap(low) != low {
+		if low {
+			fmt.Printf("Low disk space: %s free, less than %s. Downloads are paused until space is freed\n", status.FormatBytes(free), status.FormatBytes(monitor.minFree))
+		} else {
+			fmt.Printf("Disk space is available again: %s free. Downloads are resumed\n", status.FormatBytes(free))
+		}
+	}
+}
+
+// Wait - block while free space is low, returns ctx error if the run is stopped meanwhile
+func (monitor *DiskMonitor) Wait(ctx context.Context) error {
+	if monitor == nil {
+		return nil
+	}
+
+	for monitor.low.Load() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(monitor.interval):
+		}
+	}
+	return nil
+}
+
+func (monitor *DiskMonitor) Stop() {
+	if monitor != nil {
+		close(monitor.done)
+	}
+}
+
+// Preflight - estimate size of the run by HEAD requests on sample URLs and compare it with free space.
+// Returns error only in abort mode when space is not enough.
+func Preflight(ctx context.Context, httpClient *http.Client, options Options, sampleURLs []string, expectedImages int) error {
+	if options.Preflight == preflightOff || len(sampleURLs) == 0 || expectedImages == 0 {
+		return nil
+	}
+
+	if len(sampleURLs) > options.PreflightSample {
+		sampleURLs = sampleURLs[:options.PreflightSample]
+	}
+
+	var total int64
+	var known int64
+	mutex := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	urlsChan := make(chan string)
+	for jobID := 1; jobID <= options.Parallelism; jobID++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for imageURL := range urlsChan {
+				if size := headSize(ctx, httpClient, imageURL); size >= 0 {
+					mutex.Lock()
+					total += size
+					known++
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	for _, imageURL := range sampleURLs {
+		urlsChan <- imageURL
+	}
+	close(urlsChan)
+	wg.Wait()
+
+	if known == 0 {
+		fmt.Println("Preflight: can't estimate download size, sizes of sample images are unknown")
+		return nil
+	}
+
+	estimated := total / known * int64(expectedImages)
+	free, err := freeSpace(".")
+	if err != nil {
+		fmt.Println("Preflight: can't check free disk space", err)
+		return nil
+	}
+
+	fmt.Printf("Preflight: about %d images, estimated size %s (by %d sample images), free space %s\n",
+		expectedImages, status.FormatBytes(estimated), known, status.FormatBytes(free))
+
+	if free-options.MinFreeSpace >= estimated {
+		return nil
+	}
+
+	message := fmt.Sprintf("not enough disk space: estimated %s is needed, %s is free (keeping %s reserved)",
+		status.FormatBytes(estimated), status.FormatBytes(free), status.FormatBytes(options.MinFreeSpace))
+	if options.Preflight == preflightAbort {
+		return fmt.Errorf("preflight: %s", message)
+	}
+
+	fmt.Printf("Preflight warning: %s\n", message)
+	return nil
+}
+
+// SampleCatalogImages - image URLs of the first page of products for the preflight and the expected number of images
+// extrapolated to the whole catalog. Combination images are not counted. With -skip-downloaded the expected number
+// is scaled by the share of sample images which are not on disk yet. Nothing is requested when preflight is off.
+func SampleCatalogImages(ctx context.Context, httpClient *http.Client, options Options, apiToken string, status *status.Reporter) ([]string, int, error) {
+	if options.Preflight == preflightOff {
+		return nil, 0, nil
+	}
+
+	expectedImages := 0
+	if !options.SkipCategories {
+		// category has at most one image
+		expectedImages += status.GetTotalCategoriesCount()
+	}
+
+	if options.SkipProducts || status.GetTotalProductsCount() == 0 {
+		return nil, expectedImages, nil
+	}
+
+	products, err := api.LoadProducts(ctx, httpClient, options.StoreID, apiToken, 0, options.FetchLimit)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// links of category and language trees share URLs and are not downloaded again
+	var sampleURLs []string
+	seen := make(map[string]bool)
+	downloaded := 0
+	for _, product := range products.Items {
+		for _, image := range product.Images(options.Naming) {
+			if !seen[image.URL] {
+				seen[image.URL] = true
+				sampleURLs = append(sampleURLs, image.URL)
+				if _, err := os.Stat(image.Path()); err == nil {
+					downloaded++
+				}
+			}
+		}
+	}
+
+	if len(products.Items) > 0 {
+		imagesPerProduct := float64(len(sampleURLs)) / float64(len(products.Items))
+		expectedImages += int(imagesPerProduct * float64(status.GetTotalProductsCount()))
+	}
+
+	if options.Shard.Enabled() {
+		expectedImages /= options.Shard.Count
+	}
+
+	if options.SkipDownloaded && len(sampleURLs) > 0 {
+		// images already on disk are skipped, only the missing share of the catalog needs space
+		missing := float64(len(sampleURLs)-downloaded) / float64(len(sampleURLs))
+		expectedImages = int(float64(expectedImages) * missing)
+	}
+
+	return sampleURLs, expectedImages, nil
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package cmd
+
+import "syscall"
+
+// freeSpace - bytes available to unprivileged user on the filesystem of the dir
+func freeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
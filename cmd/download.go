@@ -7,120 +7,197 @@ import (
 	"net/http"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/turchenkoalex/ecwid-images-downloader/api"
 	"github.com/turchenkoalex/ecwid-images-downloader/status"
 )
 
-func DownloadProducts(ctx context.Context, httpClient *http.Client, options Options, apiToken string, imagesChan chan api.Image, status *status.Reporter) {
+// pendingProduct - product waiting for its turn to be scheduled, combinations are sent when they are loaded
+type pendingProduct struct {
+	product      api.Product
+	combinations chan []api.Image
+}
+
+// DownloadProducts - walk all products page by page and put their images to the download queue. Combinations
+// are loaded ahead by a fixed pool of workers, but images are scheduled in catalog order: images of a product,
+// then its combinations, then the next product. So paths taken by collisions are the same in every run.
+// Next page is requested only when the previous one is scheduled, so the bounded imagesChan throttles
+// catalog fetching to the speed of downloads.
+func DownloadProducts(ctx context.Context, httpClient *http.Client, options Options, apiToken string, scheduler *Scheduler, status *status.Reporter) {
+	productsChan := make(chan pendingProduct, options.CombinationsParallelism)
+	combinationsChan := make(chan pendingProduct, options.CombinationsParallelism)
+	wg := sync.WaitGroup{}
+
+	if options.UseCombinations {
+		wg.Add(options.CombinationsParallelism)
+		for jobID := 1; jobID <= options.CombinationsParallelism; jobID++ {
+			go func() {
+				defer wg.Done()
+				for pending := range combinationsChan {
+					if ctx.Err() != nil {
+						// drain the queue, so scheduleProducts never blocks
+						pending.combinations <- nil
+						continue
+					}
+					// Загрузим комбинации товара, в очередь их поставит scheduleInOrder
+					pending.combinations <- loadCombinations(ctx, httpClient, pending.product, options, apiToken, status)
+				}
+			}()
+		}
+	}
+
+	scheduled := make(chan bool, 1)
+	go func() {
+		scheduled <- scheduleInOrder(ctx, options, scheduler, productsChan, status)
+	}()
+
+	completed := scheduleProducts(ctx, httpClient, options, apiToken, scheduler, productsChan, combinationsChan, status)
+
+	// combination workers and scheduleInOrder must finish before the caller closes the scheduler
+	close(combinationsChan)
+	close(productsChan)
+	wg.Wait()
+	completed = <-scheduled && completed
+
+	if completed && ctx.Err() == nil {
+		status.MarkAllProductsScheduled()
+	}
+}
+
+func scheduleProducts(ctx context.Context, httpClient *http.Client, options Options, apiToken string, scheduler *Scheduler, productsChan chan pendingProduct, combinationsChan chan pendingProduct, status *status.Reporter) bool {
 	limit := options.FetchLimit
 	offset := 0
 	total := status.GetTotalProductsCount()
 
 	for offset < total {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			// continue processing
+		if ctx.Err() != nil {
+			return false
 		}
 
-		products, err := api.LoadProducts(httpClient, options.StoreID, apiToken, offset, limit)
+		products, err := api.LoadProducts(ctx, httpClient, options.StoreID, apiToken, offset, limit)
 		if err != nil {
-			fmt.Println("Download interrupted", err)
-			return
+			if ctx.Err() == nil {
+				fmt.Println("Download interrupted", err)
+				status.MarkCatalogError()
+			}
+			return false
 		}
 
-		wg := sync.WaitGroup{}
-
 		for _, product := range products.Items {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				// continue processing
+			if !options.Shard.Contains(product.ID) {
+				// product belongs to another shard
+				status.MarkProductProcessed()
+				continue
 			}
 
-			images := product.Images(options.IncludeNames)
-
-			for _, image := range images {
-				imagesChan <- image
-				status.MarkImageAdded()
+			if scheduler.Err() != nil {
+				return false
 			}
 
+			pending := pendingProduct{product: product, combinations: make(chan []api.Image, 1)}
+
+			// workers get the product first, so the product scheduleInOrder waits for is always loading
 			if options.UseCombinations {
-				productId := product.ID
-				productName := product.Name
-
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					// Загрузим параллельно комбинации товара и поставим их картинки в очередь
-					downloadCombinations(ctx, httpClient, productId, productName, options, apiToken, imagesChan, status)
-				}()
+				select {
+				case <-ctx.Done():
+					return false
+				case combinationsChan <- pending:
+				}
 			}
 
-			status.MarkProductProcessed()
+			select {
+			case <-ctx.Done():
+				return false
+			case productsChan <- pending:
+			}
 		}
 
-		wg.Wait()
 		offset += limit
 	}
 
-	status.MarkAllProductsScheduled()
+	return true
 }
 
-func downloadCombinations(ctx context.Context, httpClient *http.Client, productId int, productName string, options Options, apiToken string, imagesChan chan api.Image, status *status.Reporter) {
-	combinations, err := api.LoadProductCombinations(httpClient, options.StoreID, apiToken, productId)
-	if err == nil {
-		for _, combination := range combinations {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				// continue processing
-			}
+// scheduleInOrder - put images of products to the download queue in the order of the catalog,
+// returns false when the run is stopping
+func scheduleInOrder(ctx context.Context, options Options, scheduler *Scheduler, productsChan chan pendingProduct, status *status.Reporter) bool {
+	completed := true
+	for pending := range productsChan {
+		if !completed {
+			// drain the queue, so scheduleProducts never blocks
+			continue
+		}
 
-			image := combination.Image(productId, productName, options.IncludeNames)
-			if image != nil {
-				imagesChan <- *image
-				status.MarkImageAdded()
-			}
+		completed = scheduler.ScheduleAll(ctx, pending.product.Images(options.Naming))
+		if completed && options.UseCombinations {
+			completed = scheduler.ScheduleAll(ctx, <-pending.combinations)
+		}
+
+		if completed {
+			status.MarkProductProcessed()
 		}
 	}
+	return completed
+}
+
+func loadCombinations(ctx context.Context, httpClient *http.Client, product api.Product, options Options, apiToken string, status *status.Reporter) []api.Image {
+	combinations, err := api.LoadProductCombinations(ctx, httpClient, options.StoreID, apiToken, product.ID)
+	if err != nil {
+		if ctx.Err() == nil {
+			fmt.Printf("Error occurred while load combinations of product %d: %v\n", product.ID, err)
+			status.MarkCatalogError()
+		}
+		return nil
+	}
+
+	return product.CombinationImages(combinations, options.Naming)
+}
+
+// LoadCategoryTree - load all categories for category paths of product images, does nothing
+// when path templates don't use them
+func LoadCategoryTree(ctx context.Context, httpClient *http.Client, options Options, apiToken string) error {
+	if !options.Naming.UsesCategories() {
+		return nil
+	}
+
+	categories, err := api.LoadAllCategories(ctx, httpClient, options.StoreID, apiToken, options.FetchLimit)
+	if err != nil {
+		return err
+	}
+
+	options.Naming.SetCategories(categories)
+	return nil
 }
 
-func DownloadCategories(ctx context.Context, httpClient *http.Client, options Options, apiToken string, imagesChan chan api.Image, status *status.Reporter) {
+func DownloadCategories(ctx context.Context, httpClient *http.Client, options Options, apiToken string, scheduler *Scheduler, status *status.Reporter) {
 	limit := options.FetchLimit
 	offset := 0
 	total := status.GetTotalCategoriesCount()
 
 	for offset < total {
-		select {
-		case <-ctx.Done():
+		if ctx.Err() != nil {
 			return
-		default:
-			// continue processing
 		}
 
-		categories, err := api.LoadCategories(httpClient, options.StoreID, apiToken, offset, limit)
+		categories, err := api.LoadCategories(ctx, httpClient, options.StoreID, apiToken, offset, limit)
 		if err != nil {
-			fmt.Println("Download interrupted", err)
+			if ctx.Err() == nil {
+				fmt.Println("Download interrupted", err)
+				status.MarkCatalogError()
+			}
 			return
 		}
 
 		for _, category := range categories.Items {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				// continue processing
+			if !options.Shard.Contains(category.ID) {
+				// category belongs to another shard
+				status.MarkCategoryProcessed()
+				continue
 			}
 
-			image := category.Image(options.IncludeNames)
-			if image != nil {
-				imagesChan <- *image
-				status.MarkImageAdded()
+			if !scheduler.ScheduleAll(ctx, category.Images(options.Naming)) {
+				return
 			}
 			status.MarkCategoryProcessed()
 		}
@@ -128,63 +205,129 @@ func DownloadCategories(ctx context.Context, httpClient *http.Client, options Op
 		offset += limit
 	}
 
-	status.MarkAllCategoriesScheduled()
+	if ctx.Err() == nil {
+		status.MarkAllCategoriesScheduled()
+	}
 }
 
-func DownloadImages(ctx context.Context, httpClient *http.Client, options Options, imagesChan chan api.Image, status *status.Reporter) {
-	for image := range imagesChan {
-		select {
-		case <-ctx.Done():
+// DownloadImages - download images from the queue until it is closed. After ctx is canceled no new downloads
+// are started, but the queue is still drained, so producers never block and remaining images are reported
+// as interrupted. Downloads already in progress are not affected by ctx.
+func DownloadImages(ctx context.Context, httpClient *http.Client, options Options, imagesChan chan api.Image, retries *RetryQueue, concurrency *ConcurrencyController, status *status.Reporter) {
+	downloadCtx := context.WithoutCancel(ctx)
+
+	for {
+		concurrency.Acquire()
+
+		image, ok := <-imagesChan
+		if !ok {
+			concurrency.Skip()
 			return
-		default:
-			// continue processing
 		}
 
-		err := downloadFile(httpClient, options.SkipDownloaded, image)
+		// wait while disk space is low, stop also interrupts the waiting
+		if ctx.Err() != nil || diskMonitor.Wait(ctx) != nil {
+			concurrency.Skip()
+			retries.Interrupt(image)
+			status.MarkImageInterrupted()
+			continue
+		}
 
-		success := err == nil
-		status.MarkImageDownloaded(success)
+		started := time.Now()
+		downloaded, err := downloadFile(downloadCtx, httpClient, options, image, status)
+		if err == nil && !downloaded {
+			// instant skips would inflate throughput of the adjustment window
+			concurrency.Skip()
+		} else {
+			concurrency.Release(started, err)
+		}
 
 		if err != nil {
-			fmt.Printf("Error occurred while download image from %s to file %s\n", image.URL, image.FileName)
-		} else {
-			if options.Verbose {
-				fmt.Printf("Downloaded image url: %s to file: %s\n", image.URL, image.FileName)
+			if retries.Fail(image, err) {
+				status.MarkImageRetried()
+				if options.Verbose {
+					fmt.Printf("Error occurred while download image from %s to file %s, will retry: %v\n", image.URL, image.Path(), err)
+				}
+				continue
 			}
+
+			status.MarkImageDownloaded(false)
+			fmt.Printf("Error occurred while download image from %s to file %s: %v\n", image.URL, image.Path(), err)
+			continue
+		}
+
+		retries.Succeed(image)
+		status.MarkImageDownloaded(true)
+
+		if options.Verbose {
+			fmt.Printf("Downloaded image url: %s to file: %s\n", image.URL, image.Path())
 		}
 	}
 }
 
-func downloadFile(client *http.Client, skipPresent bool, image api.Image) error {
-	if _, err := os.Stat(image.FileName); err == nil {
-		if skipPresent {
-			return nil
+// downloadFile - download image to its path, returns false when no request was made: the file is already
+// on disk or the content is linked from the objects store
+func downloadFile(ctx context.Context, client *http.Client, options Options, image api.Image, status *status.Reporter) (bool, error) {
+	filePath := image.Path()
+
+	if info, err := os.Stat(filePath); err == nil {
+		// with -refresh-updated image of a product or category changed after the file was written may be changed too
+		if options.SkipDownloaded && !(options.RefreshUpdated && updatedAfter(image, info.ModTime())) {
+			return false, nil
 		}
 	}
 
-	response, err := client.Get(image.URL)
+	// content of this URL is already stored, only link it
+	if objects != nil {
+		if object, ok := objects.Lookup(image.URL); ok {
+			return false, objects.Link(object, filePath)
+		}
+	}
+
+	if err := imagesLimiter.Wait(ctx); err != nil {
+		return true, err
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, image.URL, nil)
 	if err != nil {
-		return err
+		return true, err
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return true, err
 	}
 	defer func(Body io.ReadCloser) {
 		_ = Body.Close()
 	}(response.Body)
 
-	// create the directory if it does not exist
-	if err := os.MkdirAll(image.Dir, os.ModePerm); err != nil {
-		return fmt.Errorf("failed to create directory for image: %w", err)
+	if response.StatusCode != http.StatusOK {
+		return true, statusError{code: response.StatusCode, status: response.Status}
 	}
 
-	filePath := fmt.Sprintf("%s/%s", image.Dir, image.FileName)
+	body := newIdleTimeoutReader(ctx, cancel, response.Body, options.ImageIdleTimeout)
+	defer body.Stop()
 
-	outputFile, err := os.Create(filePath)
-	if err != nil {
-		return err
+	content := &meteredReader{ctx: ctx, reader: body, status: status}
+
+	if objects != nil {
+		object, err := objects.Save(image.URL, content)
+		if err != nil {
+			return true, err
+		}
+		if err := setFileTime(object, fileTime(options.FileTimes, response, image)); err != nil {
+			return true, err
+		}
+		return true, objects.Link(object, filePath)
+	}
+
+	// create the directory if it does not exist
+	if err := os.MkdirAll(image.Dir, os.ModePerm); err != nil {
+		return true, fmt.Errorf("failed to create directory for image: %w", err)
 	}
-	defer func(outputFile *os.File) {
-		_ = outputFile.Close()
-	}(outputFile)
 
-	_, err = io.Copy(outputFile, response.Body)
-	return err
+	return true, saveFile(filePath, content, fileTime(options.FileTimes, response, image))
 }
@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/turchenkoalex/ecwid-images-downloader/api"
+)
+
+const (
+	linkModeHardlink = "hardlink"
+	linkModeSymlink  = "symlink"
+	linkModeCopy     = "copy"
+)
+
+// linkFile - make target path point to the same content as source: hardlink, symlink or copy.
+// Hardlink falls back to copy when it is not possible, e.g. on different filesystems.
+func linkFile(source string, target string, mode string) error {
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory for image: %w", err)
+	}
+
+	// replace stale file from previous runs
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	switch mode {
+	case linkModeHardlink:
+		if err := os.Link(source, target); err == nil {
+			return nil
+		}
+		return copyFile(source, target)
+	case linkModeSymlink:
+		relative, err := filepath.Rel(filepath.Dir(target), source)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(relative, target)
+	default:
+		return copyFile(source, target)
+	}
+}
+
+func copyFile(source string, target string) error {
+	input, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer func(input *os.File) {
+		_ = input.Close()
+	}(input)
+
+	// copy keeps modification time of the downloaded file like hardlinks do
+	info, err := input.Stat()
+	if err != nil {
+		return err
+	}
+	return saveFile(target, input, info.ModTime())
+}
+
+// saveFile - write content to a temp file in the dir of target and rename it when it is complete, so
+// an aborted run never leaves a truncated file which -skip-downloaded would take for a downloaded one.
+// Zero modified time keeps the time of writing.
+func saveFile(target string, content io.Reader, modified time.Time) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(target), ".download-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+	defer func() {
+		_ = os.Remove(tmpPath)
+	}()
+
+	_, err = io.Copy(tmpFile, content)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// temp files are created with 0600
+	if err := os.Chmod(tmpPath, 0o644); err != nil {
+		return err
+	}
+	if err := setFileTime(tmpPath, modified); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, target)
+}
+
+// File modification time modes
+const (
+	fileTimesLastModified = "last-modified"
+	fileTimesUpdated      = "updated"
+	fileTimesOff          = "off"
+)
+
+// fileTime - modification time for downloaded image: Last-Modified of the response or update time of its
+// product or category, zero when the time of download should be kept
+func fileTime(mode string, response *http.Response, image api.Image) time.Time {
+	if mode == fileTimesOff {
+		return time.Time{}
+	}
+
+	if mode == fileTimesLastModified {
+		if modified, err := http.ParseTime(response.Header.Get("Last-Modified")); err == nil {
+			return modified
+		}
+	}
+
+	if image.Updated > 0 {
+		return time.Unix(image.Updated, 0)
+	}
+	return time.Time{}
+}
+
+// updatedAfter - product or category of the image was updated after the given file time
+func updatedAfter(image api.Image, modified time.Time) bool {
+	return image.Updated > 0 && time.Unix(image.Updated, 0).After(modified)
+}
+
+// setFileTime - set modification time of the file, zero time is ignored
+func setFileTime(filePath string, modified time.Time) error {
+	if modified.IsZero() {
+		return nil
+	}
+	return os.Chtimes(filePath, modified, modified)
+}
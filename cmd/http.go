@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// CreateAPIClient - http client for small JSON API requests, each request is limited by total timeout
+func CreateAPIClient(options Options) *http.Client {
+	return &http.Client{
+		Timeout:   options.APITimeout,
+		Transport: createTransport(options, 0),
+	}
+}
+
+// CreateImageClient - http client for image downloads. It has no total timeout, so large originals
+// can be downloaded on slow links, stalled transfers are aborted by idle timeout instead
+func CreateImageClient(options Options) *http.Client {
+	return &http.Client{
+		Transport: createTransport(options, options.ImageHeaderTimeout),
+	}
+}
+
+func createTransport(options Options, responseHeaderTimeout time.Duration) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   options.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = options.ConnectTimeout
+	transport.ResponseHeaderTimeout = responseHeaderTimeout
+	transport.MaxIdleConnsPerHost = options.MaxParallelism
+	return transport
+}
+
+var errStalled = errors.New("transfer stalled")
+
+// idleTimeoutReader - cancels request when no data was read from the body during timeout
+type idleTimeoutReader struct {
+	reader  io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+	ctx     context.Context
+}
+
+func newIdleTimeoutReader(ctx context.Context, cancel context.CancelCauseFunc, reader io.Reader, timeout time.Duration) *idleTimeoutReader {
+	return &idleTimeoutReader{
+		reader:  reader,
+		timeout: timeout,
+		ctx:     ctx,
+		timer: time.AfterFunc(timeout, func() {
+			cancel(fmt.Errorf("%w: no data received for %s", errStalled, timeout))
+		}),
+	}
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	if err != nil && errors.Is(context.Cause(r.ctx), errStalled) {
+		return n, context.Cause(r.ctx)
+	}
+	return n, err
+}
+
+func (r *idleTimeoutReader) Stop() {
+	r.timer.Stop()
+}
@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/turchenkoalex/ecwid-images-downloader/api"
+)
+
+// imageListEntry - line of plan or failures file, path has priority over dir and file name,
+// so the target can be changed by editing a single field
+type imageListEntry struct {
+	api.Image
+	Path string `json:"path"`
+}
+
+const (
+	inputFormatAuto  = "auto"
+	inputFormatJSONL = "jsonl"
+	inputFormatCSV   = "csv"
+)
+
+// ReadImages - read images from JSON Lines file written by dry-run plan or failures report
+func ReadImages(fileName string) ([]api.Image, error) {
+	return ReadImageList(fileName, inputFormatJSONL)
+}
+
+// ReadImageList - read images from JSON Lines or CSV file, "-" means stdin. JSON Lines entries need url and path
+// (or dir and fileName), CSV rows are url,path with optional header.
+func ReadImageList(fileName string, format string) ([]api.Image, error) {
+	var reader io.Reader
+	if fileName == "-" {
+		reader = os.Stdin
+	} else {
+		file, err := os.Open(fileName)
+		if err != nil {
+			return nil, fmt.Errorf("can't open images file %s: %w", fileName, err)
+		}
+		defer func(file *os.File) {
+			_ = file.Close()
+		}(file)
+		reader = file
+	}
+
+	if format == inputFormatAuto {
+		format = inputFormatJSONL
+		if strings.EqualFold(filepath.Ext(fileName), ".csv") {
+			format = inputFormatCSV
+		}
+	}
+
+	if format == inputFormatCSV {
+		return readImagesCSV(reader, fileName)
+	}
+	return readImagesJSONLines(reader, fileName)
+}
+
+func readImagesJSONLines(reader io.Reader, fileName string) ([]api.Image, error) {
+	var images []api.Image
+	scanner := bufio.NewScanner(reader)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		var entry imageListEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("can't parse %s line %d: %w", fileName, lineNumber, err)
+		}
+
+		if entry.Path == "" && entry.FileName != "" {
+			entry.Path = entry.Image.Path()
+		}
+
+		image, err := listImage(entry.Image, entry.Path)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", fileName, lineNumber, err)
+		}
+		images = append(images, image)
+	}
+
+	return images, scanner.Err()
+}
+
+func readImagesCSV(reader io.Reader, fileName string) ([]api.Image, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+	csvReader.TrimLeadingSpace = true
+
+	urlColumn, pathColumn := 0, 1
+
+	var images []api.Image
+	for lineNumber := 1; ; lineNumber++ {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't parse %s: %w", fileName, err)
+		}
+
+		if lineNumber == 1 && slices.Contains(record, "url") {
+			// header defines column order
+			urlColumn = slices.Index(record, "url")
+			pathColumn = slices.Index(record, "path")
+			if pathColumn < 0 {
+				return nil, fmt.Errorf("%s: header has no path column", fileName)
+			}
+			continue
+		}
+
+		if len(record) <= max(urlColumn, pathColumn) {
+			return nil, fmt.Errorf("%s line %d: expected url and path columns", fileName, lineNumber)
+		}
+
+		image, err := listImage(api.Image{URL: record[urlColumn]}, record[pathColumn])
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", fileName, lineNumber, err)
+		}
+		images = append(images, image)
+	}
+
+	return images, nil
+}
+
+func listImage(image api.Image, imagePath string) (api.Image, error) {
+	image.URL = strings.TrimSpace(image.URL)
+	if image.URL == "" {
+		return image, fmt.Errorf("empty url")
+	}
+
+	if strings.TrimSpace(imagePath) == "" {
+		return image, fmt.Errorf("empty path for %s", image.URL)
+	}
+
+	if err := setImagePath(&image, imagePath); err != nil {
+		return image, err
+	}
+
+	return image, nil
+}
+
+// setImagePath - set dir and file name from relative path, paths leaving the download dir are not allowed
+func setImagePath(image *api.Image, imagePath string) error {
+	imagePath = strings.ReplaceAll(imagePath, "\\", "/")
+	cleaned := path.Clean(imagePath)
+
+	if path.IsAbs(cleaned) || hasVolumeName(cleaned) || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return fmt.Errorf("path %q must be relative to the download dir", imagePath)
+	}
+
+	image.Dir = path.Dir(cleaned)
+	image.FileName = path.Base(cleaned)
+	return nil
+}
+
+// hasVolumeName - path starts with a Windows drive letter like C:, it is absolute there on any OS
+func hasVolumeName(imagePath string) bool {
+	return len(imagePath) >= 2 && imagePath[1] == ':' &&
+		(imagePath[0] >= 'a' && imagePath[0] <= 'z' || imagePath[0] >= 'A' && imagePath[0] <= 'Z')
+}
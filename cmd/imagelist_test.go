@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/turchenkoalex/ecwid-images-downloader/api"
+)
+
+func TestReadImagesCSV(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{"no header", "https://a/1.jpg,x/1.jpg\nhttps://a/2.jpg,x/2.jpg\n", []string{"https://a/1.jpg x/1.jpg", "https://a/2.jpg x/2.jpg"}},
+		{"header", "url,path\nhttps://a/1.jpg,x/1.jpg\n", []string{"https://a/1.jpg x/1.jpg"}},
+		{"header with other order", "path,url\nx/1.jpg,https://a/1.jpg\n", []string{"https://a/1.jpg x/1.jpg"}},
+		{"header with extra columns", "sku,path,note,url\nA-1,x/1.jpg,main,https://a/1.jpg\n", []string{"https://a/1.jpg x/1.jpg"}},
+		{"spaces after commas", "https://a/1.jpg, x/1.jpg\n", []string{"https://a/1.jpg x/1.jpg"}},
+		{"file in download dir", "https://a/1.jpg,1.jpg\n", []string{"https://a/1.jpg 1.jpg"}},
+		{"backslashes", "https://a/1.jpg,x\\y\\1.jpg\n", []string{"https://a/1.jpg x/y/1.jpg"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			images, err := readImagesCSV(strings.NewReader(test.input), "test.csv")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, image := range images {
+				got = append(got, image.URL+" "+image.Path())
+			}
+			if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("images %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadImagesCSVErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{"header without path", "url,file\nhttps://a/1.jpg,x/1.jpg\n", "no path column"},
+		{"missing path column", "https://a/1.jpg\n", "expected url and path columns"},
+		{"empty url", ",x/1.jpg\n", "empty url"},
+		{"empty path", "https://a/1.jpg, \n", "empty path"},
+		{"parent dir", "https://a/1.jpg,../1.jpg\n", "must be relative"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := readImagesCSV(strings.NewReader(test.input), "test.csv")
+			if err == nil {
+				t.Fatalf("no error, want error containing %q", test.err)
+			}
+			if !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error %q, want it to contain %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestSetImagePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"products/p1.jpg", "products/p1.jpg"},
+		{"./products/p1.jpg", "products/p1.jpg"},
+		{"products/../p1.jpg", "p1.jpg"},
+		{`products\p1.jpg`, "products/p1.jpg"},
+		{"products//p1.jpg", "products/p1.jpg"},
+	}
+
+	for _, test := range tests {
+		var image api.Image
+		if err := setImagePath(&image, test.path); err != nil {
+			t.Errorf("setImagePath(%q) error %v", test.path, err)
+			continue
+		}
+		if got := image.Path(); got != test.want {
+			t.Errorf("setImagePath(%q) path %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestSetImagePathOutsideDownloadDir(t *testing.T) {
+	for _, imagePath := range []string{
+		"../p1.jpg",
+		"products/../../p1.jpg",
+		`..\p1.jpg`,
+		"..",
+		".",
+		"/etc/passwd",
+		`\windows\p1.jpg`,
+		`C:\images\p1.jpg`,
+		"c:p1.jpg",
+	} {
+		var image api.Image
+		if err := setImagePath(&image, imagePath); err == nil {
+			t.Errorf("setImagePath(%q) = %q, want error", imagePath, image.Path())
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/turchenkoalex/ecwid-images-downloader/api"
+)
+
+// FindOrphans - files in top level dirs of path templates which are not produced by the current catalog.
+// Only trees of walked subjects are checked, files which may belong to subjects that were not walked
+// (e.g. combination images without -use-combinations) are kept even when they share a tree.
+func FindOrphans(options Options, expected map[string]bool) ([]string, error) {
+	dirs := mirrorRoots(options)
+	unwalked := unwalkedTemplates(options)
+
+	var orphans []string
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(filePath string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+
+			if entry.IsDir() {
+				return nil
+			}
+
+			filePath = filepath.ToSlash(filePath)
+			if !expected[filePath] && !matchesAny(unwalked, filePath) {
+				orphans = append(orphans, filePath)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(orphans)
+	return orphans, nil
+}
+
+// mirrorRoots - top level dirs of images of walked subjects and their language trees, templates starting with a placeholder are skipped
+func mirrorRoots(options Options) []string {
+	var templates []*api.Template
+	if !options.SkipProducts {
+		templates = append(templates, options.Naming.Product)
+		if options.UseCombinations {
+			templates = append(templates, options.Naming.Combination)
+		}
+	}
+	if !options.SkipCategories {
+		templates = append(templates, options.Naming.Category)
+	}
+
+	var roots []string
+	for _, template := range templates {
+		root := template.Root()
+		if root == "" {
+			continue
+		}
+
+		for _, treeRoot := range append([]string{root}, options.Naming.TreeRoots(root)...) {
+			if !slices.Contains(roots, treeRoot) {
+				roots = append(roots, treeRoot)
+			}
+		}
+	}
+	return roots
+}
+
+// unwalkedTemplates - path templates of subjects which are not walked in this run
+func unwalkedTemplates(options Options) []*api.Template {
+	var templates []*api.Template
+	if options.SkipProducts {
+		templates = append(templates, options.Naming.Product)
+	}
+	if options.SkipProducts || !options.UseCombinations {
+		templates = append(templates, options.Naming.Combination)
+	}
+	if options.SkipCategories {
+		templates = append(templates, options.Naming.Category)
+	}
+	return templates
+}
+
+// matchesAny - file path could be rendered by one of templates, in the main tree or in a language tree
+func matchesAny(templates []*api.Template, filePath string) bool {
+	relative := filePath
+	if rest, ok := strings.CutPrefix(filePath, api.LangTreesDir+"/"); ok {
+		if _, inTree, found := strings.Cut(rest, "/"); found {
+			relative = inTree
+		}
+	}
+
+	for _, template := range templates {
+		if template.Matches(filePath) || template.Matches(relative) {
+			return true
+		}
+	}
+	return false
+}
+
+// PruneOrphans - delete orphan files or move them to the trash dir keeping relative paths
+func PruneOrphans(orphans []string, trashDir string) error {
+	for _, orphan := range orphans {
+		if trashDir == "" {
+			if err := os.Remove(orphan); err != nil {
+				return err
+			}
+		} else {
+			target := filepath.Join(trashDir, filepath.FromSlash(orphan))
+			if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+				return err
+			}
+			if err := os.Rename(orphan, target); err != nil {
+				return err
+			}
+		}
+
+		removeEmptyDirs(filepath.Dir(orphan))
+	}
+
+	return nil
+}
+
+// removeEmptyDirs - remove dir and its parents while they are empty, top level trees are kept
+func removeEmptyDirs(dir string) {
+	for filepath.Dir(dir) != "." {
+		if err := os.Remove(dir); err != nil {
+			// not empty
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// PrintOrphans - list orphan files
+func PrintOrphans(orphans []string) {
+	for _, orphan := range orphans {
+		fmt.Printf("Not in catalog: %s\n", orphan)
+	}
+}
@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/turchenkoalex/ecwid-images-downloader/api"
+)
+
+func TestFindOrphans(t *testing.T) {
+	files := []string{
+		"products/p1-101.jpg",
+		"products/p2-102.jpg",
+		"products/p1-c1.jpg",
+		"products/p1-c2-2.jpg",
+		"categories/cat10.jpg",
+		"categories/cat11-2.jpg",
+		"lang/en/products/p1-101.jpg",
+		"lang/en/products/p2-102.jpg",
+		"lang/en/products/p1-c1.jpg",
+		"lang/en/categories/cat10.jpg",
+		"failures.jsonl",
+	}
+	expected := map[string]bool{
+		"products/p1-101.jpg":          true,
+		"products/p1-c1.jpg":           true,
+		"categories/cat10.jpg":         true,
+		"lang/en/products/p1-101.jpg":  true,
+		"lang/en/products/p1-c1.jpg":   true,
+		"lang/en/categories/cat10.jpg": true,
+	}
+
+	tests := []struct {
+		name            string
+		useCombinations bool
+		skipProducts    bool
+		skipCategories  bool
+		want            []string
+	}{
+		{
+			name:            "whole catalog",
+			useCombinations: true,
+			want: []string{
+				"categories/cat11-2.jpg", "lang/en/products/p2-102.jpg", "products/p1-c2-2.jpg", "products/p2-102.jpg",
+			},
+		},
+		{
+			name: "combinations are kept without -use-combinations",
+			want: []string{
+				"categories/cat11-2.jpg", "lang/en/products/p2-102.jpg", "products/p2-102.jpg",
+			},
+		},
+		{
+			name:            "categories are kept with -skip-categories",
+			useCombinations: true,
+			skipCategories:  true,
+			want: []string{
+				"lang/en/products/p2-102.jpg", "products/p1-c2-2.jpg", "products/p2-102.jpg",
+			},
+		},
+		{
+			name:         "products and combinations are kept with -skip-products",
+			skipProducts: true,
+			want:         []string{"categories/cat11-2.jpg"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			for _, file := range files {
+				writeTestFile(t, file, "image", time.Unix(1000, 0))
+			}
+
+			naming, err := api.CreateNaming(api.NamingID, api.LayoutFlat, api.MultiCategoryDefault, "", "", "", false, false, api.PolicyPOSIX, "", []string{"en"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			options := Options{
+				Naming:          naming,
+				UseCombinations: test.useCombinations,
+				SkipProducts:    test.skipProducts,
+				SkipCategories:  test.skipCategories,
+			}
+
+			orphans, err := FindOrphans(options, expected)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(orphans, test.want) {
+				t.Errorf("orphans %q, want %q", orphans, test.want)
+			}
+		})
+	}
+}
+
+func TestFindOrphansSharedTemplateTree(t *testing.T) {
+	t.Chdir(t.TempDir())
+	for _, file := range []string{"images/p1-101.jpg", "images/p1-c1.jpg", "images/cat10.jpg", "images/cat11.jpg"} {
+		writeTestFile(t, file, "image", time.Unix(1000, 0))
+	}
+
+	naming, err := api.CreateNaming(api.NamingID, api.LayoutFlat, api.MultiCategoryDefault,
+		"images/p{product_id}-{image_id}.jpg", "images/p{product_id}-c{combination_number}.jpg", "images/cat{category_id}.jpg",
+		false, false, api.PolicyPOSIX, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// categories share the dir of products, but were not walked
+	options := Options{Naming: naming, SkipCategories: true}
+	orphans, err := FindOrphans(options, map[string]bool{"images/p1-101.jpg": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) > 0 {
+		t.Errorf("orphans %q, want none", orphans)
+	}
+}
@@ -0,0 +1,263 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/turchenkoalex/ecwid-images-downloader/api"
+)
+
+const (
+	storageFiles   = "files"
+	storageObjects = "objects"
+
+	objectsDir       = "objects"
+	objectsIndexFile = "objects/index.jsonl"
+	objectsTmpDir    = "objects/tmp"
+)
+
+// objects - content addressed store used by downloads, nil in plain files mode
+var objects *ObjectStore
+
+// objectIndexEntry - line of the index file, maps image URL to the stored object
+type objectIndexEntry struct {
+	URL    string `json:"url"`
+	Object string `json:"object"`
+}
+
+// ObjectStore - keeps every unique image once by its sha256 in objects/ab/cdef....ext,
+// image files in products/ and categories/ are links to these objects
+type ObjectStore struct {
+	linkMode  string
+	mutex     sync.Mutex
+	index     map[string]string
+	indexFile *os.File
+}
+
+// ConfigureStorage - open object store in objects storage mode, returns nil in files mode
+func ConfigureStorage(options Options) (*ObjectStore, error) {
+	if options.Storage != storageObjects {
+		return nil, nil
+	}
+
+	store, err := openObjectStore(options.ObjectsLink)
+	if err != nil {
+		return nil, err
+	}
+
+	objects = store
+	return store, nil
+}
+
+func openObjectStore(linkMode string) (*ObjectStore, error) {
+	if err := os.MkdirAll(objectsTmpDir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("can't create objects dir: %w", err)
+	}
+
+	index, err := readObjectsIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	indexFile, err := os.OpenFile(objectsIndexFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("can't open objects index: %w", err)
+	}
+
+	return &ObjectStore{
+		linkMode:  linkMode,
+		index:     index,
+		indexFile: indexFile,
+	}, nil
+}
+
+func readObjectsIndex() (map[string]string, error) {
+	index := make(map[string]string)
+
+	file, err := os.Open(objectsIndexFile)
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't open objects index: %w", err)
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry objectIndexEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// skip line broken by interrupted write, the object will be downloaded again
+			continue
+		}
+		index[entry.URL] = entry.Object
+	}
+
+	return index, scanner.Err()
+}
+
+// Lookup - object already stored for the URL
+func (store *ObjectStore) Lookup(imageURL string) (string, bool) {
+	store.mutex.Lock()
+	object, ok := store.index[imageURL]
+	store.mutex.Unlock()
+
+	if !ok {
+		return "", false
+	}
+
+	if _, err := os.Stat(object); err != nil {
+		return "", false
+	}
+
+	return object, true
+}
+
+// Save - store content downloaded from the URL, returns path of the object
+func (store *ObjectStore) Save(imageURL string, content io.Reader) (string, error) {
+	tmpFile, err := os.CreateTemp(objectsTmpDir, "download-*")
+	if err != nil {
+		return "", err
+	}
+	tmpPath := tmpFile.Name()
+	defer func() {
+		_ = os.Remove(tmpPath)
+	}()
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmpFile, hash), content)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	object := path.Join(objectsDir, sum[:2], sum[2:]+objectExtension(imageURL))
+
+	if _, err := os.Stat(object); os.IsNotExist(err) {
+		if err := os.MkdirAll(path.Dir(object), os.ModePerm); err != nil {
+			return "", err
+		}
+		if err := os.Rename(tmpPath, object); err != nil {
+			return "", err
+		}
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.index[imageURL] = object
+	line, err := json.Marshal(objectIndexEntry{URL: imageURL, Object: object})
+	if err != nil {
+		return "", err
+	}
+	if _, err := store.indexFile.Write(append(line, '\n')); err != nil {
+		return "", fmt.Errorf("can't update objects index: %w", err)
+	}
+
+	return object, nil
+}
+
+// Link - make image file point to the object
+func (store *ObjectStore) Link(object string, target string) error {
+	return linkFile(object, target, store.linkMode)
+}
+
+func (store *ObjectStore) Close() error {
+	return store.indexFile.Close()
+}
+
+// CollectGarbage - remove objects which are not referenced by any of the given URLs
+// and rewrite the index without stale entries. Returns number and total size of removed objects.
+func (store *ObjectStore) CollectGarbage(referencedURLs map[string]bool, verbose bool) (int, int64, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	referencedObjects := make(map[string]bool)
+	var entries []objectIndexEntry
+	for imageURL, object := range store.index {
+		if referencedURLs[imageURL] {
+			referencedObjects[object] = true
+			entries = append(entries, objectIndexEntry{URL: imageURL, Object: object})
+		}
+	}
+
+	removed := 0
+	freed := int64(0)
+	err := filepath.WalkDir(objectsDir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			if filepath.ToSlash(filePath) == objectsTmpDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		object := filepath.ToSlash(filePath)
+		if object == objectsIndexFile || referencedObjects[object] {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		if err := os.Remove(filePath); err != nil {
+			return err
+		}
+
+		removed++
+		freed += info.Size()
+		if verbose {
+			fmt.Printf("Removed unreferenced object %s\n", object)
+		}
+		return nil
+	})
+	if err != nil {
+		return removed, freed, err
+	}
+
+	// rewrite index, so it does not grow with removed objects
+	if err := store.indexFile.Close(); err != nil {
+		return removed, freed, err
+	}
+
+	indexFile, err := os.Create(objectsIndexFile)
+	if err != nil {
+		return removed, freed, err
+	}
+	store.indexFile = indexFile
+
+	encoder := json.NewEncoder(indexFile)
+	store.index = make(map[string]string, len(entries))
+	for _, entry := range entries {
+		store.index[entry.URL] = entry.Object
+		if err := encoder.Encode(entry); err != nil {
+			return removed, freed, err
+		}
+	}
+
+	return removed, freed, nil
+}
+
+// objectExtension - extension of the image in URL, .jpg if there is no one
+func objectExtension(imageURL string) string {
+	return "." + api.URLExtension(imageURL)
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/turchenkoalex/ecwid-images-downloader/api"
+)
+
+// PlanEntry - image which would be downloaded by the run
+type PlanEntry struct {
+	api.Image
+	Path string `json:"path"`
+	Size int64  `json:"size,omitempty"`
+}
+
+// PlanSummary - scope of the run
+type PlanSummary struct {
+	Images      map[string]int
+	UniqueURLs  int
+	Bytes       int64
+	SizeUnknown int
+}
+
+// WritePlan - read all images from the queue and write them as plan: JSON Lines when jsonLines is true, otherwise
+// human-readable lines. With options.EstimateSize each unique URL is requested with HEAD to sum up the size.
+func WritePlan(ctx context.Context, httpClient *http.Client, options Options, imagesChan chan api.Image, output io.Writer, jsonLines bool) (PlanSummary, error) {
+	summary := PlanSummary{Images: make(map[string]int)}
+	sizes := make(map[string]int64)
+	var writeErr error
+	mutex := sync.Mutex{}
+
+	write := func(entry PlanEntry, firstURL bool) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		summary.Images[entry.Source]++
+		if firstURL {
+			summary.UniqueURLs++
+			if entry.Size >= 0 {
+				summary.Bytes += entry.Size
+			} else {
+				summary.SizeUnknown++
+			}
+		}
+
+		if writeErr != nil {
+			return
+		}
+
+		if entry.Size < 0 {
+			// unknown size is omitted
+			entry.Size = 0
+		}
+
+		if jsonLines {
+			line, err := json.Marshal(entry)
+			if err == nil {
+				_, err = output.Write(append(line, '\n'))
+			}
+			writeErr = err
+			return
+		}
+
+		source := entry.Source
+		if entry.CategoryID != 0 {
+			source = fmt.Sprintf("%s %d", source, entry.CategoryID)
+		} else if entry.ProductID != 0 {
+			source = fmt.Sprintf("%s %d", source, entry.ProductID)
+		}
+		_, writeErr = fmt.Fprintf(output, "%s <- %s (%s)\n", entry.Path, entry.URL, source)
+	}
+
+	// reserve URL before HEAD, so the size is requested and counted once
+	seen := func(imageURL string) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if _, ok := sizes[imageURL]; ok {
+			return true
+		}
+		sizes[imageURL] = -1
+		return false
+	}
+
+	workers := 1
+	if options.EstimateSize {
+		workers = options.Parallelism
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+	for jobID := 1; jobID <= workers; jobID++ {
+		go func() {
+			defer wg.Done()
+			for image := range imagesChan {
+				entry := PlanEntry{Image: image, Path: image.Path(), Size: -1}
+				firstURL := !seen(image.URL)
+				if firstURL && options.EstimateSize && ctx.Err() == nil {
+					entry.Size = headSize(ctx, httpClient, image.URL)
+				}
+				write(entry, firstURL)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return summary, writeErr
+}
+
+// headSize - content length of the URL or -1 if it is unknown
+func headSize(ctx context.Context, httpClient *http.Client, imageURL string) int64 {
+	if err := imagesLimiter.Wait(ctx); err != nil {
+		return -1
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodHead, imageURL, nil)
+	if err != nil {
+		return -1
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return -1
+	}
+	_ = response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return -1
+	}
+
+	return response.ContentLength
+}
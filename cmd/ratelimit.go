@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/turchenkoalex/ecwid-images-downloader/api"
+	"github.com/turchenkoalex/ecwid-images-downloader/limiter"
+	"github.com/turchenkoalex/ecwid-images-downloader/status"
+)
+
+// imagesLimiter - limits requests to images CDN, nil means no limit
+var imagesLimiter *limiter.Limiter
+
+// bandwidthLimiter - limits total bytes per second read by all downloads, nil means no limit
+var bandwidthLimiter *limiter.Limiter
+
+// ConfigureRateLimits - create separate request budgets for API v3 and images CDN and global bandwidth cap
+func ConfigureRateLimits(options Options) error {
+	apiLimiter := limiter.CreateLimiter("API", options.APIRateLimit, options.APIBurst)
+	imagesLimiter = limiter.CreateLimiter("CDN", options.CDNRateLimit, options.CDNBurst)
+
+	if options.Verbose {
+		apiLimiter.OnDelay(printRateLimitDelay)
+		imagesLimiter.OnDelay(printRateLimitDelay)
+	}
+
+	api.SetRateLimiter(apiLimiter)
+
+	if options.MaxBandwidth > 0 {
+		// one second worth of bytes as burst, but not less than a single read
+		bandwidthLimiter = limiter.CreateLimiter("bandwidth", float64(options.MaxBandwidth), int(max(options.MaxBandwidth, bandwidthChunkSize)))
+	}
+
+	if options.BandwidthSchedule != "" {
+		if bandwidthLimiter == nil {
+			return fmt.Errorf("-bandwidth-schedule requires -max-bandwidth")
+		}
+
+		schedule, err := limiter.ParseSchedule(options.BandwidthSchedule)
+		if err != nil {
+			return fmt.Errorf("invalid -bandwidth-schedule: %w", err)
+		}
+		bandwidthLimiter.SetSchedule(schedule)
+	}
+
+	return nil
+}
+
+func printRateLimitDelay(name string, delay time.Duration) {
+	fmt.Printf("Rate limit: %s request delayed by %s\n", name, delay.Round(time.Millisecond))
+}
+
+// bandwidthChunkSize - max bytes read at once, so the bandwidth is shared between downloads evenly
+const bandwidthChunkSize = 32 * 1024
+
+// meteredReader - accounts downloaded bytes and waits for the global bandwidth budget
+type meteredReader struct {
+	ctx    context.Context
+	reader io.Reader
+	status *status.Reporter
+}
+
+func (r *meteredReader) Read(p []byte) (int, error) {
+	if bandwidthLimiter != nil && len(p) > bandwidthChunkSize {
+		p = p[:bandwidthChunkSize]
+	}
+
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.status.MarkBytesDownloaded(int64(n))
+		if waitErr := bandwidthLimiter.WaitN(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,235 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/turchenkoalex/ecwid-images-downloader/api"
+	"github.com/turchenkoalex/ecwid-images-downloader/status"
+)
+
+// FailedImage - image that could not be downloaded after all attempts
+type FailedImage struct {
+	api.Image
+	Path     string `json:"path"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error"`
+}
+
+var errInterrupted = errors.New("interrupted")
+
+type pendingImage struct {
+	image api.Image
+	due   time.Time
+}
+
+// RetryQueue - collects failed downloads, schedules them again with backoff and
+// remembers images which failed permanently
+type RetryQueue struct {
+	maxAttempts int
+	backoff     time.Duration
+	mutex       sync.Mutex
+	attempts    map[string]int
+	pending     []pendingImage
+	failed      []FailedImage
+}
+
+func CreateRetryQueue(maxAttempts int, backoff time.Duration) *RetryQueue {
+	return &RetryQueue{
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		attempts:    make(map[string]int),
+	}
+}
+
+// Fail - register failed attempt, returns true if image will be retried later. Permanent errors
+// like 404 or a file which can't be created fail the image at once.
+func (queue *RetryQueue) Fail(image api.Image, err error) bool {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	path := image.Path()
+	queue.attempts[path]++
+	attempts := queue.attempts[path]
+
+	if attempts < queue.maxAttempts && isTransient(err) {
+		// 1x, 2x, 4x ... of base backoff
+		delay := queue.backoff * time.Duration(1<<(attempts-1))
+		queue.pending = append(queue.pending, pendingImage{image: image, due: time.Now().Add(delay)})
+		return true
+	}
+
+	delete(queue.attempts, path)
+	queue.failed = append(queue.failed, FailedImage{
+		Image:    image,
+		Path:     path,
+		Attempts: attempts,
+		Error:    err.Error(),
+	})
+	return false
+}
+
+// isTransient - error may go away on the next attempt: transport errors, timeouts, 429 and 5xx responses
+func isTransient(err error) bool {
+	if isThrottled(err) {
+		return true
+	}
+
+	var responseErr statusError
+	if errors.As(err, &responseErr) {
+		return responseErr.code == http.StatusRequestTimeout
+	}
+
+	// local file system errors won't be fixed by waiting
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	return !errors.As(err, &pathErr) && !errors.As(err, &linkErr)
+}
+
+// Interrupt - remember image which was not downloaded because the run was stopped
+func (queue *RetryQueue) Interrupt(image api.Image) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	path := image.Path()
+	queue.failed = append(queue.failed, FailedImage{
+		Image:    image,
+		Path:     path,
+		Attempts: queue.attempts[path],
+		Error:    errInterrupted.Error(),
+	})
+	delete(queue.attempts, path)
+}
+
+// interruptPending - move all images waiting for retry to interrupted, returns their count
+func (queue *RetryQueue) interruptPending() int {
+	queue.mutex.Lock()
+	images := queue.pending
+	queue.pending = nil
+	queue.mutex.Unlock()
+
+	for _, pending := range images {
+		queue.Interrupt(pending.image)
+	}
+	return len(images)
+}
+
+// Succeed - forget attempts of successfully downloaded image
+func (queue *RetryQueue) Succeed(image api.Image) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	delete(queue.attempts, image.Path())
+}
+
+// Failed - images failed permanently
+func (queue *RetryQueue) Failed() []FailedImage {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	return append([]FailedImage(nil), queue.failed...)
+}
+
+// takeDue - returns images ready for the next attempt and the time when next pending image will be ready
+func (queue *RetryQueue) takeDue(now time.Time) ([]api.Image, time.Time) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	var due []api.Image
+	var next time.Time
+	rest := queue.pending[:0]
+	for _, pending := range queue.pending {
+		if !pending.due.After(now) {
+			due = append(due, pending.image)
+			continue
+		}
+
+		if next.IsZero() || pending.due.Before(next) {
+			next = pending.due
+		}
+		rest = append(rest, pending)
+	}
+	queue.pending = rest
+
+	return due, next
+}
+
+// DownloadRetries - download images from retry queue until all of them succeed or fail permanently
+func DownloadRetries(ctx context.Context, httpClient *http.Client, options Options, queue *RetryQueue, concurrency *ConcurrencyController, status *status.Reporter) {
+	for {
+		if ctx.Err() != nil {
+			for range queue.interruptPending() {
+				status.MarkImageInterrupted()
+			}
+			return
+		}
+
+		images, next := queue.takeDue(time.Now())
+		if len(images) == 0 {
+			if next.IsZero() {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Until(next)):
+			}
+			continue
+		}
+
+		if options.Verbose {
+			fmt.Printf("Retrying %d failed images\n", len(images))
+		}
+
+		imagesChan := make(chan api.Image, len(images))
+		for _, image := range images {
+			imagesChan <- image
+		}
+		close(imagesChan)
+
+		wg := sync.WaitGroup{}
+		wg.Add(concurrency.Workers())
+		for jobID := 1; jobID <= concurrency.Workers(); jobID++ {
+			go func() {
+				defer wg.Done()
+				DownloadImages(ctx, httpClient, options, imagesChan, queue, concurrency, status)
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// WriteFailures - write permanently failed images as JSON Lines, removes stale file if nothing failed
+func WriteFailures(fileName string, failures []FailedImage) error {
+	if len(failures) == 0 {
+		err := os.Remove(fileName)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	encoder := json.NewEncoder(file)
+	for _, failed := range failures {
+		if err := encoder.Encode(failed); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
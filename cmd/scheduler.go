@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"context"
+	"sync"
+
+	"github.com/turchenkoalex/ecwid-images-downloader/api"
+	"github.com/turchenkoalex/ecwid-images-downloader/status"
+)
+
+// Scheduler - puts images found in the catalog to the download queue
+type Scheduler struct {
+	imagesChan chan api.Image
+	dedup      *Deduplicator
+	collisions *CollisionResolver
+	status     *status.Reporter
+
+	// paths of all scheduled images, collected only when tracking is enabled
+	mutex    sync.Mutex
+	expected map[string]bool
+
+	// first path collision in fail mode, scheduling stops after it
+	err error
+}
+
+func CreateScheduler(imagesChan chan api.Image, dedup *Deduplicator, collisions *CollisionResolver, status *status.Reporter) *Scheduler {
+	return &Scheduler{
+		imagesChan: imagesChan,
+		dedup:      dedup,
+		collisions: collisions,
+		status:     status,
+	}
+}
+
+// TrackExpectedPaths - remember paths of all scheduled images, including duplicates
+func (scheduler *Scheduler) TrackExpectedPaths() {
+	scheduler.expected = make(map[string]bool)
+}
+
+// ExpectedPaths - paths of all scheduled images, nil if tracking is not enabled
+func (scheduler *Scheduler) ExpectedPaths() map[string]bool {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	return scheduler.expected
+}
+
+// Schedule - put image to the download queue, returns false when the run is stopping
+func (scheduler *Scheduler) Schedule(ctx context.Context, image api.Image) bool {
+	if scheduler.Err() != nil {
+		return false
+	}
+
+	// catalog entities are needed only for sidecars, queues and registries keep images without them
+	metadata := image.Metadata
+	image.Metadata = nil
+
+	image, err := scheduler.collisions.Resolve(image)
+	if err != nil {
+		scheduler.mutex.Lock()
+		if scheduler.err == nil {
+			scheduler.err = err
+		}
+		scheduler.mutex.Unlock()
+		return false
+	}
+
+	sidecarPath := sidecars.Add(image, metadata)
+
+	if scheduler.expected != nil {
+		scheduler.mutex.Lock()
+		scheduler.expected[image.Path()] = true
+		if sidecarPath != "" {
+			scheduler.expected[sidecarPath] = true
+		}
+		scheduler.mutex.Unlock()
+	}
+
+	if !scheduler.dedup.Add(image) {
+		// same URL is already scheduled, file will be linked or copied after the run
+		scheduler.status.MarkImageDeduplicated()
+		return true
+	}
+
+	select {
+	case <-ctx.Done():
+		scheduler.dedup.Remove(image)
+		return false
+	case scheduler.imagesChan <- image:
+		scheduler.status.MarkImageAdded()
+		return true
+	}
+}
+
+// ScheduleAll - put all images to the download queue, returns false when the run is stopping
+func (scheduler *Scheduler) ScheduleAll(ctx context.Context, images []api.Image) bool {
+	for _, image := range images {
+		if !scheduler.Schedule(ctx, image) {
+			return false
+		}
+	}
+	return true
+}
+
+// Collisions - images renamed because their paths were taken by other images
+func (scheduler *Scheduler) Collisions() []Collision {
+	return scheduler.collisions.Resolved()
+}
+
+// Err - path collision which stopped scheduling in fail mode
+func (scheduler *Scheduler) Err() error {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	return scheduler.err
+}
+
+// Close - no more images will be scheduled
+func (scheduler *Scheduler) Close() {
+	close(scheduler.imagesChan)
+}
@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Shard - part k of n of the catalog, entities are assigned to shards by hash of their ID
+type Shard struct {
+	Index int
+	Count int
+}
+
+func (shard *Shard) String() string {
+	if shard.Count == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", shard.Index, shard.Count)
+}
+
+func (shard *Shard) Set(value string) error {
+	parts := strings.Split(value, "/")
+	if len(parts) != 2 {
+		return fmt.Errorf("expected k/n, e.g. 2/5")
+	}
+
+	index, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return fmt.Errorf("invalid shard number %q", parts[0])
+	}
+
+	count, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return fmt.Errorf("invalid shards count %q", parts[1])
+	}
+
+	if count < 1 || index < 1 || index > count {
+		return fmt.Errorf("shard number must be between 1 and shards count")
+	}
+
+	shard.Index = index
+	shard.Count = count
+	return nil
+}
+
+// Enabled - run processes only a part of the catalog
+func (shard Shard) Enabled() bool {
+	return shard.Count > 1
+}
+
+// Contains - entity with the ID belongs to this shard
+func (shard Shard) Contains(id int) bool {
+	if !shard.Enabled() {
+		return true
+	}
+
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(strconv.Itoa(id)))
+	return int(hash.Sum32()%uint32(shard.Count)) == shard.Index-1
+}
+
+// suffix - file name suffix, so shards running in the same dir don't overwrite reports of each other
+func (shard Shard) suffix() string {
+	if !shard.Enabled() {
+		return ""
+	}
+	return fmt.Sprintf(".shard-%d-of-%d", shard.Index, shard.Count)
+}
+
+// MergeLists - merge JSON Lines plans or failure reports of shards into one file. Entries are identified
+// by their target path, the later entry with the same path replaces the earlier one.
+func MergeLists(output string, inputs []string) (int, error) {
+	if len(inputs) == 0 {
+		return 0, fmt.Errorf("no files to merge, pass them as arguments after flags")
+	}
+
+	var order []string
+	lines := make(map[string][]byte)
+
+	for _, input := range inputs {
+		file, err := os.Open(input)
+		if err != nil {
+			return 0, err
+		}
+
+		scanner := bufio.NewScanner(file)
+		lineNumber := 0
+		for scanner.Scan() {
+			lineNumber++
+			if len(strings.TrimSpace(scanner.Text())) == 0 {
+				continue
+			}
+
+			var entry imageListEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				_ = file.Close()
+				return 0, fmt.Errorf("can't parse %s line %d: %w", input, lineNumber, err)
+			}
+
+			key := entry.Path
+			if key == "" {
+				key = entry.Image.Path()
+			}
+
+			if _, ok := lines[key]; !ok {
+				order = append(order, key)
+			}
+			lines[key] = append([]byte(nil), scanner.Bytes()...)
+		}
+
+		err = scanner.Err()
+		_ = file.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	file, err := os.Create(output)
+	if err != nil {
+		return 0, err
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	writer := bufio.NewWriter(file)
+	for _, key := range order {
+		if _, err := writer.Write(append(lines[key], '\n')); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(order), writer.Flush()
+}
@@ -0,0 +1,270 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/turchenkoalex/ecwid-images-downloader/api"
+)
+
+// Sidecar modes
+const (
+	sidecarsOff     = "off"
+	sidecarsImage   = "image"
+	sidecarsProduct = "product"
+)
+
+// sidecars - writer of metadata files used by the scheduler, nil when sidecars are off
+var sidecars *SidecarWriter
+
+// SidecarWriter - collects catalog metadata of scheduled images and writes it as JSON next to downloaded
+// images: one file per image, or one file per product in the dir of its first image. Only the fields
+// written to sidecars are kept, not the catalog entities.
+type SidecarWriter struct {
+	mode         string
+	lang         string
+	mutex        sync.Mutex
+	entries      []sidecarEntry
+	products     map[int]*productSidecar
+	productPaths map[int]string
+}
+
+// sidecarEntry - metadata of scheduled image and path of its sidecar file
+type sidecarEntry struct {
+	sidecarPath string
+	sidecar     imageSidecar
+}
+
+// imageSidecar - content of image sidecar file
+type imageSidecar struct {
+	Path        string              `json:"path"`
+	URL         string              `json:"url"`
+	Source      string              `json:"source"`
+	Product     *productSidecar     `json:"product,omitempty"`
+	Image       *productImageFields `json:"image,omitempty"`
+	Combination *combinationFields  `json:"combination,omitempty"`
+	Category    *categoryFields     `json:"category,omitempty"`
+}
+
+// productSidecar - product fields, in product mode with all its downloaded images
+type productSidecar struct {
+	ID                int               `json:"id"`
+	Sku               string            `json:"sku,omitempty"`
+	Name              string            `json:"name"`
+	LocalName         string            `json:"localName,omitempty"`
+	NameTranslated    map[string]string `json:"nameTranslated,omitempty"`
+	CategoryIds       []int             `json:"categoryIds,omitempty"`
+	DefaultCategoryID int               `json:"defaultCategoryId,omitempty"`
+	Updated           string            `json:"updated,omitempty"`
+	Images            []imageSidecar    `json:"images,omitempty"`
+}
+
+type productImageFields struct {
+	ID            string            `json:"id"`
+	Position      int               `json:"position"`
+	Alt           string            `json:"alt,omitempty"`
+	AltTranslated map[string]string `json:"altTranslated,omitempty"`
+}
+
+type combinationFields struct {
+	ID                int                 `json:"id"`
+	CombinationNumber int                 `json:"combinationNumber"`
+	Sku               string              `json:"sku,omitempty"`
+	Options           []combinationOption `json:"options,omitempty"`
+}
+
+type combinationOption struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type categoryFields struct {
+	ID             int               `json:"id"`
+	ParentID       int               `json:"parentId,omitempty"`
+	Name           string            `json:"name"`
+	LocalName      string            `json:"localName,omitempty"`
+	NameTranslated map[string]string `json:"nameTranslated,omitempty"`
+	Updated        string            `json:"updated,omitempty"`
+}
+
+// ConfigureSidecars - create sidecar writer for the run, returns nil when sidecars are off
+func ConfigureSidecars(options Options) *SidecarWriter {
+	if options.Sidecars == sidecarsOff {
+		return nil
+	}
+
+	sidecars = &SidecarWriter{
+		mode:         options.Sidecars,
+		lang:         options.Lang,
+		products:     make(map[int]*productSidecar),
+		productPaths: make(map[int]string),
+	}
+	return sidecars
+}
+
+// Add - remember metadata of scheduled image, returns path of its sidecar file or empty string when it has no metadata
+func (writer *SidecarWriter) Add(image api.Image, metadata *api.ImageMetadata) string {
+	if writer == nil || metadata == nil {
+		return ""
+	}
+
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+
+	entry := sidecarEntry{sidecar: writer.imageSidecar(image, metadata)}
+	if writer.mode == sidecarsProduct && metadata.Product != nil {
+		// p{id}.json in the dir of the first product image
+		productPath, ok := writer.productPaths[image.ProductID]
+		if !ok {
+			productPath = path.Join(image.Dir, fmt.Sprintf("p%d.json", image.ProductID))
+			writer.productPaths[image.ProductID] = productPath
+		}
+		entry.sidecarPath = productPath
+	} else {
+		entry.sidecarPath = strings.TrimSuffix(image.Path(), path.Ext(image.FileName)) + ".json"
+	}
+
+	writer.entries = append(writer.entries, entry)
+	return entry.sidecarPath
+}
+
+// Write - write sidecars of images which are on disk after the run, returns number of written files
+func (writer *SidecarWriter) Write() (int, error) {
+	if writer == nil {
+		return 0, nil
+	}
+
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+
+	written := 0
+	products := make(map[string]productSidecar)
+	var productPaths []string
+	for _, entry := range writer.entries {
+		sidecar := entry.sidecar
+		if _, err := os.Stat(sidecar.Path); err != nil {
+			// not downloaded
+			continue
+		}
+
+		if writer.mode == sidecarsProduct && sidecar.Product != nil {
+			product, ok := products[entry.sidecarPath]
+			if !ok {
+				product = *sidecar.Product
+				productPaths = append(productPaths, entry.sidecarPath)
+			}
+			sidecar.Product = nil
+			product.Images = append(product.Images, sidecar)
+			products[entry.sidecarPath] = product
+			continue
+		}
+
+		if err := writeJSONFile(entry.sidecarPath, sidecar); err != nil {
+			return written, err
+		}
+		written++
+	}
+
+	for _, productPath := range productPaths {
+		product := products[productPath]
+		sort.SliceStable(product.Images, func(i, j int) bool {
+			return product.Images[i].Path < product.Images[j].Path
+		})
+		if err := writeJSONFile(productPath, product); err != nil {
+			return written, err
+		}
+		written++
+	}
+
+	return written, nil
+}
+
+// imageSidecar - sidecar fields of the image, product fields are shared by all images of the product
+func (writer *SidecarWriter) imageSidecar(image api.Image, metadata *api.ImageMetadata) imageSidecar {
+	sidecar := imageSidecar{
+		Path:   image.Path(),
+		URL:    image.URL,
+		Source: image.Source,
+	}
+
+	if product := metadata.Product; product != nil {
+		sidecar.Product = writer.products[product.ID]
+		if sidecar.Product == nil {
+			sidecar.Product = &productSidecar{
+				ID:                product.ID,
+				Sku:               product.Sku,
+				Name:              product.Name,
+				NameTranslated:    product.NameTranslated,
+				CategoryIds:       product.CategoryIds,
+				DefaultCategoryID: product.DefaultCategoryID,
+				Updated:           product.Updated,
+			}
+			if writer.lang != "" {
+				sidecar.Product.LocalName = product.LocalName(writer.lang)
+			}
+			writer.products[product.ID] = sidecar.Product
+		}
+	}
+
+	if productImage := metadata.ProductImage; productImage != nil {
+		sidecar.Image = &productImageFields{
+			ID:            productImage.ID,
+			Position:      metadata.Position,
+			Alt:           translatedAlt(productImage.Alt, writer.lang),
+			AltTranslated: productImage.Alt.Translated,
+		}
+	}
+
+	if combination := metadata.Combination; combination != nil {
+		sidecar.Combination = &combinationFields{
+			ID:                combination.ID,
+			CombinationNumber: combination.CombinationNumber,
+			Sku:               combination.Sku,
+		}
+		for _, option := range combination.Options {
+			sidecar.Combination.Options = append(sidecar.Combination.Options, combinationOption{
+				Name:  option.LocalName(writer.lang),
+				Value: option.LocalValue(writer.lang),
+			})
+		}
+	}
+
+	if category := metadata.Category; category != nil {
+		sidecar.Category = &categoryFields{
+			ID:             category.ID,
+			ParentID:       category.ParentID,
+			Name:           category.Name,
+			NameTranslated: category.NameTranslated,
+			Updated:        category.Updated,
+		}
+		if writer.lang != "" {
+			sidecar.Category.LocalName = category.LocalName(writer.lang)
+		}
+	}
+
+	return sidecar
+}
+
+// translatedAlt - alt text in the language, main alt text when there is no translation
+func translatedAlt(alt api.ProductImageAlt, lang string) string {
+	if translated := alt.Translated[lang]; lang != "" && translated != "" {
+		return translated
+	}
+	return alt.Main
+}
+
+func writeJSONFile(fileName string, value any) error {
+	content, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	// readers of the sidecar never see a half written file, even when the run is killed
+	return saveFile(fileName, bytes.NewReader(append(content, '\n')), time.Time{})
+}
@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// HandleSignals - returns context which is canceled on the first SIGINT/SIGTERM, so the run stops scheduling
+// new images and lets in-flight downloads finish. The second signal terminates the process immediately.
+func HandleSignals() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+		fmt.Println("Stopping: waiting for in-flight downloads to finish, press Ctrl+C again to abort immediately")
+		cancel()
+
+		<-signals
+		fmt.Println("Aborted")
+		os.Exit(130)
+	}()
+
+	return ctx
+}
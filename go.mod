@@ -1,3 +1,5 @@
 module github.com/turchenkoalex/ecwid-images-downloader
 
 go 1.25.1
+
+require golang.org/x/text v0.40.0
@@ -0,0 +1,98 @@
+package limiter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter - token bucket which allows rate requests per second on average with bursts up to burst requests
+type Limiter struct {
+	name     string
+	rate     float64
+	burst    float64
+	schedule *Schedule
+	onDelay  func(name string, delay time.Duration)
+
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// CreateLimiter - create limiter, zero or negative rate means no limit
+func CreateLimiter(name string, rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &Limiter{
+		name:   name,
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// OnDelay - register callback called each time a request has to wait for a token
+func (limiter *Limiter) OnDelay(callback func(name string, delay time.Duration)) {
+	limiter.onDelay = callback
+}
+
+// SetSchedule - apply limit only in the schedule time windows, without schedule the limit is always active
+func (limiter *Limiter) SetSchedule(schedule *Schedule) {
+	limiter.schedule = schedule
+}
+
+// Wait - block until the next request is allowed or ctx is done
+func (limiter *Limiter) Wait(ctx context.Context) error {
+	return limiter.WaitN(ctx, 1)
+}
+
+// WaitN - block until n tokens (e.g. bytes) are allowed or ctx is done
+func (limiter *Limiter) WaitN(ctx context.Context, n int) error {
+	if limiter == nil || limiter.rate <= 0 {
+		return nil
+	}
+
+	if limiter.schedule != nil && !limiter.schedule.Contains(time.Now()) {
+		return nil
+	}
+
+	delay := limiter.reserve(float64(n))
+	if delay <= 0 {
+		return nil
+	}
+
+	if limiter.onDelay != nil {
+		limiter.onDelay(limiter.name, delay)
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// reserve - take n tokens, returns how long to wait until they are actually available
+func (limiter *Limiter) reserve(n float64) time.Duration {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	limiter.tokens = min(limiter.burst, limiter.tokens+now.Sub(limiter.last).Seconds()*limiter.rate)
+	limiter.last = now
+
+	// tokens can go below zero, so waiting requests are served in order of arrival
+	limiter.tokens -= n
+	if limiter.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))
+}
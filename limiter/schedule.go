@@ -0,0 +1,75 @@
+package limiter
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schedule - set of daily time windows in local time, e.g. "09:00-18:00,20:00-02:00"
+type Schedule struct {
+	windows []window
+}
+
+// window - minutes from midnight, end before start means the window wraps over midnight
+type window struct {
+	start int
+	end   int
+}
+
+// ParseSchedule - parse comma separated list of HH:MM-HH:MM windows
+func ParseSchedule(value string) (*Schedule, error) {
+	schedule := &Schedule{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		bounds := strings.Split(part, "-")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid schedule window %q, expected HH:MM-HH:MM", part)
+		}
+
+		start, err := parseClock(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+
+		end, err := parseClock(bounds[1])
+		if err != nil {
+			return nil, err
+		}
+
+		schedule.windows = append(schedule.windows, window{start: start, end: end})
+	}
+
+	if len(schedule.windows) == 0 {
+		return nil, fmt.Errorf("empty schedule")
+	}
+
+	return schedule, nil
+}
+
+// Contains - check that moment is inside one of the windows
+func (schedule *Schedule) Contains(moment time.Time) bool {
+	minute := moment.Hour()*60 + moment.Minute()
+	for _, w := range schedule.windows {
+		if w.start <= w.end {
+			if minute >= w.start && minute < w.end {
+				return true
+			}
+		} else if minute >= w.start || minute < w.end {
+			return true
+		}
+	}
+	return false
+}
+
+func parseClock(value string) (int, error) {
+	clock, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return clock.Hour()*60 + clock.Minute(), nil
+}
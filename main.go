@@ -2,12 +2,11 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
-	"os/signal"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/turchenkoalex/ecwid-images-downloader/cmd"
@@ -17,7 +16,8 @@ import (
 )
 
 func main() {
-	ctx, _ := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	// Первый сигнал останавливает планирование новых загрузок, второй завершает процесс сразу
+	ctx := cmd.HandleSignals()
 
 	cmd.PrintVersion()
 
@@ -27,6 +27,16 @@ func main() {
 		os.Exit(1)
 	}
 
+	if options.Merge != "" {
+		merged, err := cmd.MergeLists(options.Merge, flag.Args())
+		if err != nil {
+			fmt.Println("Error occurred while merge files", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Merged %d entries into %s\n", merged, options.Merge)
+		return
+	}
+
 	if options.SkipProducts && options.SkipCategories {
 		fmt.Println("Skip categories and products in same time not allowed")
 		os.Exit(1)
@@ -41,7 +51,45 @@ func main() {
 		subject = "products and categories"
 	}
 
-	httpClient := &http.Client{Timeout: 15 * time.Second}
+	// Раздельные лимиты частоты запросов для API и CDN картинок
+	if err := cmd.ConfigureRateLimits(options); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// В режиме objects каждая уникальная картинка хранится один раз, а в products/ и categories/ лежат ссылки
+	store, err := cmd.ConfigureStorage(options)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if store != nil {
+		defer func(store *cmd.ObjectStore) {
+			_ = store.Close()
+		}(store)
+	}
+
+	// Отдельные клиенты: для коротких запросов в API и для скачивания больших картинок
+	httpClient := cmd.CreateAPIClient(options)
+	imageClient := cmd.CreateImageClient(options)
+
+	if options.RetryFailed {
+		images, err := cmd.ReadImages(options.FailuresFile)
+		downloadList(ctx, imageClient, options, options.FailuresFile, images, err)
+		return
+	}
+
+	if options.ExecutePlan != "" {
+		images, err := cmd.ReadImages(options.ExecutePlan)
+		downloadList(ctx, imageClient, options, options.ExecutePlan, images, err)
+		return
+	}
+
+	if options.Input != "" {
+		images, err := cmd.ReadImageList(options.Input, options.InputFormat)
+		downloadList(ctx, imageClient, options, options.Input, images, err)
+		return
+	}
 
 	var apiToken string
 	if len(options.Token) == 0 {
@@ -55,7 +103,17 @@ func main() {
 		os.Exit(1)
 	}
 
-	fmt.Printf("Start downloading %s images (combinations mode: %v) for store %d with token %s to dir %s. (parallelism: %d)\n",
+	action := "downloading"
+	if options.DryRun {
+		action = "planning"
+	}
+
+	if options.Shard.Enabled() {
+		subject = fmt.Sprintf("%s (shard %s)", subject, options.Shard.String())
+	}
+
+	fmt.Printf("Start %s %s images (combinations mode: %v) for store %d with token %s to dir %s. (parallelism: %d)\n",
+		action,
 		subject,
 		options.UseCombinations,
 		options.StoreID,
@@ -68,7 +126,7 @@ func main() {
 	totalCategoriesCount := 0
 
 	if !options.SkipProducts {
-		totalProductCount, err = api.LoadProductsTotalCount(httpClient, options.StoreID, apiToken)
+		totalProductCount, err = api.LoadProductsTotalCount(ctx, httpClient, options.StoreID, apiToken)
 		if err != nil {
 			fmt.Println("Error occurred while calculate products count", err)
 			return
@@ -76,7 +134,7 @@ func main() {
 	}
 
 	if !options.SkipCategories {
-		totalCategoriesCount, err = api.LoadCategoriesTotalCount(httpClient, options.StoreID, apiToken)
+		totalCategoriesCount, err = api.LoadCategoriesTotalCount(ctx, httpClient, options.StoreID, apiToken)
 		if err != nil {
 			fmt.Println("Error occurred while calculate categories count", err)
 			return
@@ -92,58 +150,348 @@ func main() {
 		fmt.Printf("Found %d products and %d categories\n", totalProductCount, totalCategoriesCount)
 	}
 
+	// Дерево категорий нужно для раскладки картинок товаров по папкам категорий
+	err = cmd.LoadCategoryTree(ctx, httpClient, options, apiToken)
+	if err != nil {
+		fmt.Println("Error occurred while load categories tree", err)
+		return
+	}
+
 	// Репортилка о текущем статусе
 	reporter := status.CreateReporter(totalProductCount, totalCategoriesCount)
 
+	if options.CollectGarbage {
+		collectGarbage(ctx, httpClient, options, apiToken, store, reporter)
+		return
+	}
+
+	if options.DryRun {
+		dryRun(ctx, httpClient, imageClient, options, apiToken, reporter)
+		return
+	}
+
+	// Проверим, что места на диске хватит, и будем следить за ним во время загрузки
+	sampleURLs, expectedImages, err := cmd.SampleCatalogImages(ctx, httpClient, options, apiToken, reporter)
+	if err != nil {
+		fmt.Println("Error occurred while sample images for preflight", err)
+	} else {
+		checkDiskSpace(ctx, imageClient, options, sampleURLs, expectedImages)
+	}
+	defer cmd.StartDiskMonitor(options, 10*time.Second).Stop()
+
 	// репортаем состояние каждые 5 секунд
 	reporter.Start(5 * time.Second)
 
-	// Это очередь для скачивания, сюда будем накидывать все картинки которые нужно качать
-	imagesChan := make(chan api.Image, 20000)
+	// Это очередь для скачивания, сюда будем накидывать все картинки которые нужно качать.
+	// Очередь ограничена, поэтому обход каталога ждет, пока загрузчики не разгребут ее
+	imagesChan := make(chan api.Image, options.QueueSize)
 
-	// Запускаем parallelism параллельных задач на скачивание картинок
-	downloadsWG := &sync.WaitGroup{}
-	downloadsWG.Add(options.Parallelism)
-	for jobID := 1; jobID <= options.Parallelism; jobID++ {
-		go func() {
-			defer downloadsWG.Done()
-			cmd.DownloadImages(ctx, httpClient, options, imagesChan, reporter)
-		}()
+	// Картинки с уже запланированным URL не качаем повторно, а делаем ссылки или копии после загрузки
+	dedup := cmd.CreateDeduplicator(options.Dedup)
+
+	// Метаданные каталога для JSON файлов рядом с картинками, пишутся после загрузки
+	sidecars := cmd.ConfigureSidecars(options)
+
+	// Разные картинки с одинаковым путем (без учета регистра) переименовываем или останавливаемся
+	collisions := cmd.CreateCollisionResolver(options.Collisions)
+	scheduler := cmd.CreateScheduler(imagesChan, dedup, collisions, reporter)
+	if options.Mirror {
+		scheduler.TrackExpectedPaths()
 	}
 
-	wg := &sync.WaitGroup{}
+	// Неудачные загрузки попадают в очередь повторов
+	retries := cmd.CreateRetryQueue(options.Retries, options.RetryBackoff)
 
-	// загрузим все товары и поставим загрузку картинок в очередь imagesChan
-	if !options.SkipProducts {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			cmd.DownloadProducts(ctx, httpClient, options, apiToken, imagesChan, reporter)
-		}()
+	// Ограничитель числа одновременных загрузок, в адаптивном режиме подстраивается каждые 5 секунд
+	concurrency := cmd.CreateConcurrencyController(options, reporter)
+	concurrency.Start(5 * time.Second)
+
+	// Запускаем параллельные задачи на скачивание картинок
+	downloadsWG := startDownloads(ctx, imageClient, options, imagesChan, retries, concurrency, reporter)
+
+	// Обходим каталог и ставим картинки в очередь
+	walkCatalog(ctx, httpClient, options, apiToken, scheduler, reporter)
+
+	// и ждем когда завершатся все задачи на скачивание
+	downloadsWG.Wait()
+
+	finish(ctx, imageClient, options, scheduler, retries, concurrency, dedup, reporter)
+
+	if written, err := sidecars.Write(); err != nil {
+		fmt.Println("Error occurred while write metadata files", err)
+	} else if written > 0 {
+		fmt.Printf("Metadata of images is saved to %d JSON files\n", written)
+	}
+
+	if options.Mirror {
+		mirror(ctx, options, scheduler.ExpectedPaths(), reporter)
+	}
+}
+
+// mirror - удаляет локальные картинки, которых больше нет в каталоге, только после полного обхода без ошибок
+func mirror(ctx context.Context, options cmd.Options, expected map[string]bool, reporter *status.Reporter) {
+	if ctx.Err() != nil || !reporter.CatalogComplete() {
+		fmt.Println("Mirror: catalog was not walked completely, nothing removed")
+		return
+	}
+
+	orphans, err := cmd.FindOrphans(options, expected)
+	if err != nil {
+		fmt.Println("Error occurred while search images which are no longer in the catalog", err)
+		return
+	}
+
+	if len(orphans) == 0 {
+		fmt.Println("Mirror: all local images are in the catalog")
+		return
+	}
+
+	cmd.PrintOrphans(orphans)
+
+	if options.MirrorDryRun {
+		fmt.Printf("Mirror: %d local images are no longer in the catalog, run without -mirror-dry-run to remove them\n", len(orphans))
+		return
+	}
+
+	if err := cmd.PruneOrphans(orphans, options.MirrorTrash); err != nil {
+		fmt.Println("Error occurred while remove images which are no longer in the catalog", err)
+		return
+	}
+
+	if options.MirrorTrash != "" {
+		fmt.Printf("Mirror: moved %d images which are no longer in the catalog to %s\n", len(orphans), options.MirrorTrash)
 	} else {
-		reporter.MarkAllProductsScheduled()
+		fmt.Printf("Mirror: removed %d images which are no longer in the catalog\n", len(orphans))
+	}
+}
+
+// downloadList - скачивает только картинки из списка (план, неудачи предыдущего запуска или внешний список), без обхода каталога
+func downloadList(ctx context.Context, httpClient *http.Client, options cmd.Options, fileName string, images []api.Image, err error) {
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if len(images) == 0 {
+		fmt.Printf("No images found in %s. Nothing to download.\n", fileName)
+		return
 	}
 
-	// загрузим все категории и поставим загрузку картинок в очередь imagesChan
+	fmt.Printf("Start downloading %d images from %s to dir %s. (parallelism: %d)\n",
+		len(images),
+		fileName,
+		options.DownloadDir,
+		options.Parallelism,
+	)
+
+	sampleURLs := make([]string, 0, min(len(images), options.PreflightSample))
+	for i := 0; i < len(images) && i < options.PreflightSample; i++ {
+		sampleURLs = append(sampleURLs, images[i].URL)
+	}
+	checkDiskSpace(ctx, httpClient, options, sampleURLs, len(images))
+	defer cmd.StartDiskMonitor(options, 10*time.Second).Stop()
+
+	reporter := status.CreateReporter(0, 0)
+	reporter.Start(5 * time.Second)
+
+	imagesChan := make(chan api.Image, options.QueueSize)
+	dedup := cmd.CreateDeduplicator(options.Dedup)
+
+	// план выполняем ровно как записан: его пути уже проверены при -dry-run, переименование изменило бы записи
+	var collisions *cmd.CollisionResolver
+	if options.ExecutePlan == "" {
+		collisions = cmd.CreateCollisionResolver(options.Collisions)
+	}
+
+	scheduler := cmd.CreateScheduler(imagesChan, dedup, collisions, reporter)
+	retries := cmd.CreateRetryQueue(options.Retries, options.RetryBackoff)
+	concurrency := cmd.CreateConcurrencyController(options, reporter)
+	concurrency.Start(5 * time.Second)
+	downloadsWG := startDownloads(ctx, httpClient, options, imagesChan, retries, concurrency, reporter)
+
+	// загрузчики вычитывают очередь до конца даже после остановки, поэтому запись не заблокируется
+	scheduler.ScheduleAll(context.WithoutCancel(ctx), images)
+	reporter.MarkAllProductsScheduled()
+	reporter.MarkAllCategoriesScheduled()
+	scheduler.Close()
+	downloadsWG.Wait()
+
+	finish(ctx, httpClient, options, scheduler, retries, concurrency, dedup, reporter)
+}
+
+// walkCatalog - загружает все товары и категории, ставит их картинки в очередь и закрывает ее после обхода.
+// Категории и товары обходятся по очереди: при совпадении путей переименование не зависит от скорости запросов
+func walkCatalog(ctx context.Context, httpClient *http.Client, options cmd.Options, apiToken string, scheduler *cmd.Scheduler, reporter *status.Reporter) {
+	// загрузим все категории и поставим загрузку картинок в очередь, их обычно немного, поэтому они первые
 	if !options.SkipCategories {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			cmd.DownloadCategories(ctx, httpClient, options, apiToken, imagesChan, reporter)
-		}()
+		cmd.DownloadCategories(ctx, httpClient, options, apiToken, scheduler, reporter)
 	} else {
 		reporter.MarkAllCategoriesScheduled()
 	}
 
-	// Ждем когда очедь картинок будет наполнена
-	wg.Wait()
+	// загрузим все товары и поставим загрузку картинок в очередь
+	if !options.SkipProducts {
+		cmd.DownloadProducts(ctx, httpClient, options, apiToken, scheduler, reporter)
+	} else {
+		reporter.MarkAllProductsScheduled()
+	}
 
-	// так как мы больше не будем писать в imagesChan, закрываем его
-	close(imagesChan)
+	// так как мы больше не будем писать в очередь, закрываем ее
+	scheduler.Close()
+}
 
-	// и ждем когда завершатся все задачи на скачивание
-	downloadsWG.Wait()
+// collectGarbage - обходит каталог без скачивания и удаляет объекты, на которые он больше не ссылается
+func collectGarbage(ctx context.Context, httpClient *http.Client, options cmd.Options, apiToken string, store *cmd.ObjectStore, reporter *status.Reporter) {
+	reporter.Start(5 * time.Second)
+
+	imagesChan := make(chan api.Image, options.QueueSize)
+	scheduler := cmd.CreateScheduler(imagesChan, nil, nil, reporter)
+
+	referencedURLs := make(map[string]bool)
+	collected := make(chan interface{})
+	go func() {
+		defer close(collected)
+		for image := range imagesChan {
+			referencedURLs[image.URL] = true
+		}
+	}()
+
+	walkCatalog(ctx, httpClient, options, apiToken, scheduler, reporter)
+	<-collected
+	reporter.Stop()
+
+	// объекты удаляем только если видели весь каталог, иначе можно удалить нужные
+	if !reporter.CatalogComplete() || options.SkipProducts || options.SkipCategories {
+		fmt.Println("Garbage collection requires complete catalog walk of products and categories, nothing removed")
+		os.Exit(1)
+	}
+
+	removed, freed, err := store.CollectGarbage(referencedURLs, options.Verbose)
+	if err != nil {
+		fmt.Println("Error occurred while collect garbage", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Removed %d unreferenced objects, freed %s\n", removed, status.FormatBytes(freed))
+}
+
+// dryRun - обходит каталог как обычно, но вместо скачивания выводит план загрузки
+func dryRun(ctx context.Context, httpClient *http.Client, imageClient *http.Client, options cmd.Options, apiToken string, reporter *status.Reporter) {
+	output := os.Stdout
+	if options.PlanFile != "" {
+		file, err := os.Create(options.PlanFile)
+		if err != nil {
+			fmt.Println("Can't create plan file", err)
+			os.Exit(1)
+		}
+		defer func(file *os.File) {
+			_ = file.Close()
+		}(file)
+		output = file
+
+		// план выводится в stdout только без файла, иначе можно показывать статус
+		reporter.Start(5 * time.Second)
+	}
+
+	imagesChan := make(chan api.Image, options.QueueSize)
+	scheduler := cmd.CreateScheduler(imagesChan, nil, cmd.CreateCollisionResolver(options.Collisions), reporter)
+
+	var summary cmd.PlanSummary
+	var err error
+	planned := make(chan interface{})
+	go func() {
+		defer close(planned)
+		summary, err = cmd.WritePlan(ctx, imageClient, options, imagesChan, output, options.PlanFile != "")
+	}()
+
+	walkCatalog(ctx, httpClient, options, apiToken, scheduler, reporter)
+	<-planned
+
+	if options.PlanFile != "" {
+		reporter.Stop()
+	}
+
+	if err != nil {
+		fmt.Println("Error occurred while write plan", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Dry run: %d product images, %d combination images, %d category images, %d unique URLs\n",
+		summary.Images[api.SourceProduct],
+		summary.Images[api.SourceCombination],
+		summary.Images[api.SourceCategory],
+		summary.UniqueURLs,
+	)
+
+	if options.EstimateSize {
+		fmt.Printf("Estimated download size: %s", status.FormatBytes(summary.Bytes))
+		if summary.SizeUnknown > 0 {
+			fmt.Printf(" (size of %d URLs is unknown)", summary.SizeUnknown)
+		}
+		fmt.Println()
+	}
+
+	cmd.PrintCollisions(scheduler.Collisions())
+
+	if options.PlanFile != "" {
+		fmt.Printf("Plan is saved to %s\n", options.PlanFile)
+	}
+
+	if err := scheduler.Err(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if !reporter.CatalogComplete() {
+		fmt.Println("Catalog was not walked completely, the plan is partial")
+	}
+}
+
+// checkDiskSpace - оценивает объем загрузки и сравнивает со свободным местом, в режиме abort завершает процесс
+func checkDiskSpace(ctx context.Context, httpClient *http.Client, options cmd.Options, sampleURLs []string, expectedImages int) {
+	if err := cmd.Preflight(ctx, httpClient, options, sampleURLs, expectedImages); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func startDownloads(ctx context.Context, httpClient *http.Client, options cmd.Options, imagesChan chan api.Image, retries *cmd.RetryQueue, concurrency *cmd.ConcurrencyController, reporter *status.Reporter) *sync.WaitGroup {
+	downloadsWG := &sync.WaitGroup{}
+	downloadsWG.Add(concurrency.Workers())
+	for jobID := 1; jobID <= concurrency.Workers(); jobID++ {
+		go func() {
+			defer downloadsWG.Done()
+			cmd.DownloadImages(ctx, httpClient, options, imagesChan, retries, concurrency, reporter)
+		}()
+	}
+	return downloadsWG
+}
+
+// finish - докачивает отложенные повторы, создает дубликаты, сохраняет окончательные неудачи и выводит финальное сообщение
+func finish(ctx context.Context, httpClient *http.Client, options cmd.Options, scheduler *cmd.Scheduler, retries *cmd.RetryQueue, concurrency *cmd.ConcurrencyController, dedup *cmd.Deduplicator, reporter *status.Reporter) {
+	cmd.DownloadRetries(ctx, httpClient, options, retries, concurrency, reporter)
+	concurrency.Stop()
+
+	failures := retries.Failed()
+	failures = append(failures, dedup.Materialize(options, failures, reporter)...)
+	if err := cmd.WriteFailures(options.FailuresFile, failures); err != nil {
+		fmt.Println("Error occurred while write failures file", err)
+	}
 
 	// Завершили все работы, останвливаем репортилку и выводим финальное сообщение
 	reporter.Done()
+	cmd.PrintCollisions(scheduler.Collisions())
+
+	if len(failures) > 0 {
+		fmt.Printf("Failed and not downloaded images are saved to %s/%s, run again with -retry-failed to download them\n", options.DownloadDir, options.FailuresFile)
+	}
+
+	if err := scheduler.Err(); err != nil {
+		fmt.Println("Run stopped:", err)
+		os.Exit(1)
+	}
+
+	if ctx.Err() != nil && !options.RetryFailed && options.ExecutePlan == "" && options.Input == "" {
+		fmt.Println("Catalog was not processed completely, run again with -skip-downloaded to continue")
+	}
 }
@@ -9,6 +9,15 @@ import (
 type Reporter struct {
 	imageDownloadErrors      int32
 	imageDownloadSuccess     int32
+	imageRetries             int32
+	imageInterrupted         int32
+	concurrency              int32
+	imageDeduplicated        int32
+	deduplicationSavedBytes  int64
+	bytesDownloaded          int64
+	lastBytesDownloaded      int64
+	lastPrintTime            time.Time
+	startTime                time.Time
 	imageTotalCount          int32
 	productsCount            int
 	productsProcessedCount   int32
@@ -16,6 +25,7 @@ type Reporter struct {
 	categoriesProcessedCount int32
 	allCategoriesScheduled   int32
 	allProductsScheduled     int32
+	catalogErrors            int32
 	done                     chan interface{}
 }
 
@@ -23,6 +33,13 @@ func CreateReporter(productsCount int, categoriesCount int) *Reporter {
 	return &Reporter{
 		imageDownloadErrors:      0,
 		imageDownloadSuccess:     0,
+		imageRetries:             0,
+		imageInterrupted:         0,
+		concurrency:              0,
+		imageDeduplicated:        0,
+		deduplicationSavedBytes:  0,
+		bytesDownloaded:          0,
+		startTime:                time.Now(),
 		imageTotalCount:          0,
 		productsCount:            productsCount,
 		productsProcessedCount:   0,
@@ -30,6 +47,7 @@ func CreateReporter(productsCount int, categoriesCount int) *Reporter {
 		categoriesProcessedCount: 0,
 		allCategoriesScheduled:   0,
 		allProductsScheduled:     0,
+		catalogErrors:            0,
 		done:                     make(chan interface{}),
 	}
 }
@@ -67,6 +85,16 @@ func (status *Reporter) allImagesScheduled() bool {
 		atomic.LoadInt32(&status.allProductsScheduled) == 1
 }
 
+// MarkCatalogError - part of the catalog could not be loaded
+func (status *Reporter) MarkCatalogError() {
+	atomic.AddInt32(&status.catalogErrors, 1)
+}
+
+// CatalogComplete - all products and categories were walked without errors
+func (status *Reporter) CatalogComplete() bool {
+	return status.allImagesScheduled() && atomic.LoadInt32(&status.catalogErrors) == 0
+}
+
 func (status *Reporter) MarkImageDownloaded(success bool) {
 	if success {
 		atomic.AddInt32(&status.imageDownloadSuccess, 1)
@@ -75,7 +103,35 @@ func (status *Reporter) MarkImageDownloaded(success bool) {
 	}
 }
 
+func (status *Reporter) MarkImageRetried() {
+	atomic.AddInt32(&status.imageRetries, 1)
+}
+
+func (status *Reporter) MarkImageInterrupted() {
+	atomic.AddInt32(&status.imageInterrupted, 1)
+}
+
+func (status *Reporter) SetConcurrency(concurrency int) {
+	atomic.StoreInt32(&status.concurrency, int32(concurrency))
+}
+
+// MarkImageDeduplicated - image has the same URL as already scheduled one and won't be downloaded again
+func (status *Reporter) MarkImageDeduplicated() {
+	atomic.AddInt32(&status.imageDeduplicated, 1)
+}
+
+// MarkDeduplicationSaved - duplicate image of given size was created without downloading
+func (status *Reporter) MarkDeduplicationSaved(size int64) {
+	atomic.AddInt64(&status.deduplicationSavedBytes, size)
+}
+
+func (status *Reporter) MarkBytesDownloaded(size int64) {
+	atomic.AddInt64(&status.bytesDownloaded, size)
+}
+
 func (status *Reporter) Start(duration time.Duration) {
+	status.startTime = time.Now()
+	status.lastPrintTime = status.startTime
 	status.printStatus()
 
 	go func() {
@@ -97,6 +153,18 @@ func (status *Reporter) printStatus() {
 	productsProcessedCount := atomic.LoadInt32(&status.productsProcessedCount)
 	imagesProcessed := atomic.LoadInt32(&status.imageDownloadErrors) + atomic.LoadInt32(&status.imageDownloadSuccess)
 	imagesTotalCount := atomic.LoadInt32(&status.imageTotalCount)
+	imageRetries := atomic.LoadInt32(&status.imageRetries)
+	concurrency := atomic.LoadInt32(&status.concurrency)
+	bytesDownloaded := atomic.LoadInt64(&status.bytesDownloaded)
+
+	// throughput since the previous status line
+	now := time.Now()
+	throughput := int64(0)
+	if elapsed := now.Sub(status.lastPrintTime).Seconds(); elapsed > 0 {
+		throughput = int64(float64(bytesDownloaded-status.lastBytesDownloaded) / elapsed)
+	}
+	status.lastBytesDownloaded = bytesDownloaded
+	status.lastPrintTime = now
 
 	categoriesPercent := float32(1)
 	if status.categoriesCount > 0 {
@@ -131,6 +199,22 @@ func (status *Reporter) printStatus() {
 		imagesPercentString,
 	)
 
+	if imageRetries > 0 {
+		fmt.Printf(" Retries %d.", imageRetries)
+	}
+
+	if concurrency > 0 {
+		fmt.Printf(" Concurrency %d.", concurrency)
+	}
+
+	if bytesDownloaded > 0 {
+		fmt.Printf(" Throughput %s/s.", FormatBytes(throughput))
+	}
+
+	if imageDeduplicated := atomic.LoadInt32(&status.imageDeduplicated); imageDeduplicated > 0 {
+		fmt.Printf(" Duplicates %d.", imageDeduplicated)
+	}
+
 	if status.categoriesCount > 0 {
 		fmt.Printf(" Processed categories %d of %d (%2.f%%)",
 			categoriesProcessedCount,
@@ -150,9 +234,32 @@ func (status *Reporter) printStatus() {
 	fmt.Println()
 }
 
-func (status *Reporter) Done() {
+// Stop - stop periodic status output
+func (status *Reporter) Stop() {
 	status.done <- nil
 	close(status.done)
+}
 
-	fmt.Printf("[100%%]: Successfully downloaded: %d images, failed: %d images\n", status.imageDownloadSuccess, status.imageDownloadErrors)
+func (status *Reporter) Done() {
+	status.Stop()
+
+	if status.imageInterrupted > 0 {
+		fmt.Printf("[stopped]: Successfully downloaded: %d images, failed: %d images, retries: %d, not downloaded because of stop: %d images\n", status.imageDownloadSuccess, status.imageDownloadErrors, status.imageRetries, status.imageInterrupted)
+		return
+	}
+
+	fmt.Printf("[100%%]: Successfully downloaded: %d images, failed: %d images, retries: %d\n", status.imageDownloadSuccess, status.imageDownloadErrors, status.imageRetries)
+
+	if status.imageDeduplicated > 0 {
+		fmt.Printf("Deduplicated: %d images with already scheduled URLs, saved %s of downloads\n", status.imageDeduplicated, FormatBytes(status.deduplicationSavedBytes))
+	}
+
+	if status.bytesDownloaded > 0 {
+		elapsed := time.Since(status.startTime)
+		fmt.Printf("Downloaded %s in %s (%s/s)\n",
+			FormatBytes(status.bytesDownloaded),
+			elapsed.Round(time.Second),
+			FormatBytes(int64(float64(status.bytesDownloaded)/max(elapsed.Seconds(), 1))),
+		)
+	}
 }